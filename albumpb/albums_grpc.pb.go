@@ -0,0 +1,339 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: albums.proto
+
+package albumpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AlbumService_ListAlbums_FullMethodName  = "/albums.v1.AlbumService/ListAlbums"
+	AlbumService_GetAlbum_FullMethodName    = "/albums.v1.AlbumService/GetAlbum"
+	AlbumService_CreateAlbum_FullMethodName = "/albums.v1.AlbumService/CreateAlbum"
+	AlbumService_UpdateAlbum_FullMethodName = "/albums.v1.AlbumService/UpdateAlbum"
+	AlbumService_DeleteAlbum_FullMethodName = "/albums.v1.AlbumService/DeleteAlbum"
+	AlbumService_WatchAlbums_FullMethodName = "/albums.v1.AlbumService/WatchAlbums"
+)
+
+// AlbumServiceClient is the client API for AlbumService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// AlbumService is the album catalog over gRPC. It shares the store,
+// validation, auditing and webhooks of the web API, so an album written
+// here is indistinguishable from one written through a form.
+type AlbumServiceClient interface {
+	// ListAlbums pages through live albums in the order they were added.
+	ListAlbums(ctx context.Context, in *ListAlbumsRequest, opts ...grpc.CallOption) (*ListAlbumsResponse, error)
+	GetAlbum(ctx context.Context, in *GetAlbumRequest, opts ...grpc.CallOption) (*Album, error)
+	CreateAlbum(ctx context.Context, in *CreateAlbumRequest, opts ...grpc.CallOption) (*Album, error)
+	// UpdateAlbum replaces an album's title, artist and price, and whichever
+	// other fields are set. It fails with ABORTED if the album is no longer
+	// at the given version.
+	UpdateAlbum(ctx context.Context, in *UpdateAlbumRequest, opts ...grpc.CallOption) (*Album, error)
+	// DeleteAlbum moves an album to the trash, returning it as it was
+	// deleted.
+	DeleteAlbum(ctx context.Context, in *DeleteAlbumRequest, opts ...grpc.CallOption) (*Album, error)
+	// WatchAlbums streams the changes feed: every change committed after the
+	// cursor, in order, then new ones as they happen.
+	WatchAlbums(ctx context.Context, in *WatchAlbumsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AlbumChange], error)
+}
+
+type albumServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAlbumServiceClient(cc grpc.ClientConnInterface) AlbumServiceClient {
+	return &albumServiceClient{cc}
+}
+
+func (c *albumServiceClient) ListAlbums(ctx context.Context, in *ListAlbumsRequest, opts ...grpc.CallOption) (*ListAlbumsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListAlbumsResponse)
+	err := c.cc.Invoke(ctx, AlbumService_ListAlbums_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *albumServiceClient) GetAlbum(ctx context.Context, in *GetAlbumRequest, opts ...grpc.CallOption) (*Album, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Album)
+	err := c.cc.Invoke(ctx, AlbumService_GetAlbum_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *albumServiceClient) CreateAlbum(ctx context.Context, in *CreateAlbumRequest, opts ...grpc.CallOption) (*Album, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Album)
+	err := c.cc.Invoke(ctx, AlbumService_CreateAlbum_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *albumServiceClient) UpdateAlbum(ctx context.Context, in *UpdateAlbumRequest, opts ...grpc.CallOption) (*Album, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Album)
+	err := c.cc.Invoke(ctx, AlbumService_UpdateAlbum_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *albumServiceClient) DeleteAlbum(ctx context.Context, in *DeleteAlbumRequest, opts ...grpc.CallOption) (*Album, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Album)
+	err := c.cc.Invoke(ctx, AlbumService_DeleteAlbum_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *albumServiceClient) WatchAlbums(ctx context.Context, in *WatchAlbumsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[AlbumChange], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AlbumService_ServiceDesc.Streams[0], AlbumService_WatchAlbums_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchAlbumsRequest, AlbumChange]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AlbumService_WatchAlbumsClient = grpc.ServerStreamingClient[AlbumChange]
+
+// AlbumServiceServer is the server API for AlbumService service.
+// All implementations must embed UnimplementedAlbumServiceServer
+// for forward compatibility.
+//
+// AlbumService is the album catalog over gRPC. It shares the store,
+// validation, auditing and webhooks of the web API, so an album written
+// here is indistinguishable from one written through a form.
+type AlbumServiceServer interface {
+	// ListAlbums pages through live albums in the order they were added.
+	ListAlbums(context.Context, *ListAlbumsRequest) (*ListAlbumsResponse, error)
+	GetAlbum(context.Context, *GetAlbumRequest) (*Album, error)
+	CreateAlbum(context.Context, *CreateAlbumRequest) (*Album, error)
+	// UpdateAlbum replaces an album's title, artist and price, and whichever
+	// other fields are set. It fails with ABORTED if the album is no longer
+	// at the given version.
+	UpdateAlbum(context.Context, *UpdateAlbumRequest) (*Album, error)
+	// DeleteAlbum moves an album to the trash, returning it as it was
+	// deleted.
+	DeleteAlbum(context.Context, *DeleteAlbumRequest) (*Album, error)
+	// WatchAlbums streams the changes feed: every change committed after the
+	// cursor, in order, then new ones as they happen.
+	WatchAlbums(*WatchAlbumsRequest, grpc.ServerStreamingServer[AlbumChange]) error
+	mustEmbedUnimplementedAlbumServiceServer()
+}
+
+// UnimplementedAlbumServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAlbumServiceServer struct{}
+
+func (UnimplementedAlbumServiceServer) ListAlbums(context.Context, *ListAlbumsRequest) (*ListAlbumsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAlbums not implemented")
+}
+func (UnimplementedAlbumServiceServer) GetAlbum(context.Context, *GetAlbumRequest) (*Album, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAlbum not implemented")
+}
+func (UnimplementedAlbumServiceServer) CreateAlbum(context.Context, *CreateAlbumRequest) (*Album, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAlbum not implemented")
+}
+func (UnimplementedAlbumServiceServer) UpdateAlbum(context.Context, *UpdateAlbumRequest) (*Album, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateAlbum not implemented")
+}
+func (UnimplementedAlbumServiceServer) DeleteAlbum(context.Context, *DeleteAlbumRequest) (*Album, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAlbum not implemented")
+}
+func (UnimplementedAlbumServiceServer) WatchAlbums(*WatchAlbumsRequest, grpc.ServerStreamingServer[AlbumChange]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchAlbums not implemented")
+}
+func (UnimplementedAlbumServiceServer) mustEmbedUnimplementedAlbumServiceServer() {}
+func (UnimplementedAlbumServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeAlbumServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AlbumServiceServer will
+// result in compilation errors.
+type UnsafeAlbumServiceServer interface {
+	mustEmbedUnimplementedAlbumServiceServer()
+}
+
+func RegisterAlbumServiceServer(s grpc.ServiceRegistrar, srv AlbumServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAlbumServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AlbumService_ServiceDesc, srv)
+}
+
+func _AlbumService_ListAlbums_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAlbumsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlbumServiceServer).ListAlbums(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AlbumService_ListAlbums_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlbumServiceServer).ListAlbums(ctx, req.(*ListAlbumsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AlbumService_GetAlbum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetAlbumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlbumServiceServer).GetAlbum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AlbumService_GetAlbum_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlbumServiceServer).GetAlbum(ctx, req.(*GetAlbumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AlbumService_CreateAlbum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAlbumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlbumServiceServer).CreateAlbum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AlbumService_CreateAlbum_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlbumServiceServer).CreateAlbum(ctx, req.(*CreateAlbumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AlbumService_UpdateAlbum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateAlbumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlbumServiceServer).UpdateAlbum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AlbumService_UpdateAlbum_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlbumServiceServer).UpdateAlbum(ctx, req.(*UpdateAlbumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AlbumService_DeleteAlbum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteAlbumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AlbumServiceServer).DeleteAlbum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AlbumService_DeleteAlbum_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AlbumServiceServer).DeleteAlbum(ctx, req.(*DeleteAlbumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AlbumService_WatchAlbums_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchAlbumsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AlbumServiceServer).WatchAlbums(m, &grpc.GenericServerStream[WatchAlbumsRequest, AlbumChange]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AlbumService_WatchAlbumsServer = grpc.ServerStreamingServer[AlbumChange]
+
+// AlbumService_ServiceDesc is the grpc.ServiceDesc for AlbumService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AlbumService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "albums.v1.AlbumService",
+	HandlerType: (*AlbumServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListAlbums",
+			Handler:    _AlbumService_ListAlbums_Handler,
+		},
+		{
+			MethodName: "GetAlbum",
+			Handler:    _AlbumService_GetAlbum_Handler,
+		},
+		{
+			MethodName: "CreateAlbum",
+			Handler:    _AlbumService_CreateAlbum_Handler,
+		},
+		{
+			MethodName: "UpdateAlbum",
+			Handler:    _AlbumService_UpdateAlbum_Handler,
+		},
+		{
+			MethodName: "DeleteAlbum",
+			Handler:    _AlbumService_DeleteAlbum_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchAlbums",
+			Handler:       _AlbumService_WatchAlbums_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "albums.proto",
+}
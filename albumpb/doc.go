@@ -0,0 +1,5 @@
+// Package albumpb is the protocol buffer definition of AlbumService and
+// the code generated from it.
+package albumpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative albums.proto
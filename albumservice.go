@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example/web-service-gin/albumpb"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultGRPCAddr is where AlbumService listens when GRPC_ADDR is not set.
+const defaultGRPCAddr = ":9090"
+
+// grpcToken is the bearer token gRPC callers must send, set from
+// GRPC_TOKEN at startup. There is no proxy in front of the port to vouch
+// for callers, so AlbumService is not served without one.
+var grpcToken string
+
+// grpcActor is who the audit log credits with changes made over gRPC.
+// Every caller holds the same token, so that is all that is known of them.
+const grpcActor = "grpc"
+
+var (
+	// grpcCalls counts calls by method and status code, and grpcSeconds
+	// adds up the time they took by method. Both are served at
+	// /debug/vars.
+	grpcCalls   = expvar.NewMap("grpc_calls")
+	grpcSeconds = expvar.NewMap("grpc_seconds")
+)
+
+// albumService is AlbumService over the same store as the web API. Writes
+// go through createAlbum, updateAlbum and deleteAlbum with the fields
+// bound as if from a form, so they are validated, audited and sent to
+// webhooks exactly as form writes are.
+type albumService struct {
+	albumpb.UnimplementedAlbumServiceServer
+}
+
+// grpcServer is the gRPC side of the process: AlbumService, health
+// checks and reflection.
+type grpcServer struct {
+	srv    *grpc.Server
+	health *health.Server
+}
+
+// startGRPC starts serving on addr.
+func startGRPC(addr string) (*grpcServer, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptor(countCall), unaryInterceptor(logCall), unaryInterceptor(authorizeCall)),
+		grpc.ChainStreamInterceptor(streamInterceptor(countCall), streamInterceptor(logCall), streamInterceptor(authorizeCall)),
+	)
+	albumpb.RegisterAlbumServiceServer(srv, albumService{})
+	hs := health.NewServer()
+	hs.SetServingStatus(albumpb.AlbumService_ServiceDesc.ServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(srv, hs)
+	reflection.Register(srv)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+	}()
+	return &grpcServer{srv: srv, health: hs}, nil
+}
+
+// Stop reports the service as not serving, then lets calls in progress
+// finish until ctx is done. Watch streams end as soon as serverClosing is
+// closed.
+func (s *grpcServer) Stop(ctx context.Context) {
+	s.health.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Printf("Failed to finish gRPC calls before shutting down: %v", ctx.Err())
+		s.srv.Stop()
+	}
+}
+
+// grpcInterceptor wraps a call to method, unary or streaming alike. It
+// runs the call with the context it is given.
+type grpcInterceptor func(ctx context.Context, method string, call func(ctx context.Context) error) error
+
+func unaryInterceptor(i grpcInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		err = i(ctx, info.FullMethod, func(ctx context.Context) error {
+			var err error
+			resp, err = handler(ctx, req)
+			return err
+		})
+		return resp, err
+	}
+}
+
+func streamInterceptor(i grpcInterceptor) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return i(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+			return handler(srv, contextStream{ss, ctx})
+		})
+	}
+}
+
+// contextStream is a stream whose handler sees a context the interceptors
+// added to.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context { return s.ctx }
+
+func countCall(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	start := time.Now()
+	err := call(ctx)
+	grpcCalls.Add(method+" "+status.Code(err).String(), 1)
+	grpcSeconds.AddFloat(method, time.Since(start).Seconds())
+	return err
+}
+
+type grpcRequestIDKey struct{}
+
+// logCall logs each call once it ends, tagged like web requests with an
+// ID, kept from the x-request-id metadata if the caller sent one.
+func logCall(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	start := time.Now()
+	id := metadataValue(ctx, "x-request-id")
+	if id == "" {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	err := call(context.WithValue(ctx, grpcRequestIDKey{}, id))
+
+	addr := "-"
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	log.Printf("[gRPC] %s | %-18s | %12v | %s | %s", id, status.Code(err), time.Since(start), addr, method)
+	return err
+}
+
+type grpcAuditorKey struct{}
+
+// authorizeCall checks the bearer token and records who the call is made
+// by for the audit log. Health checks need no token, so that orchestrators
+// can make them.
+func authorizeCall(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	if !strings.HasPrefix(method, "/grpc.health.v1.") {
+		given := metadataValue(ctx, "authorization")
+		if grpcToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+grpcToken)) != 1 {
+			return status.Error(codes.Unauthenticated, "a valid bearer token is required")
+		}
+	}
+	who := auditor{actor: grpcActor}
+	who.requestID, _ = ctx.Value(grpcRequestIDKey{}).(string)
+	return call(context.WithValue(ctx, grpcAuditorKey{}, who))
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func callAuditor(ctx context.Context) auditor {
+	who, ok := ctx.Value(grpcAuditorKey{}).(auditor)
+	if !ok {
+		return auditor{actor: "anonymous"}
+	}
+	return who
+}
+
+// getMetrics serves the process's expvar counters, the gRPC ones among
+// them, to staff.
+func getMetrics(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can see metrics"})
+		return
+	}
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+func albumMessage(a album) *albumpb.Album {
+	m := &albumpb.Album{
+		Id:                a.ID,
+		Title:             a.Title,
+		Artist:            a.Artist,
+		ArtistId:          a.ArtistID,
+		Price:             a.Price,
+		Version:           a.Version,
+		Year:              int32(a.Year),
+		Label:             a.Label,
+		Format:            a.Format,
+		CatalogNumber:     a.CatalogNumber,
+		Barcode:           a.Barcode,
+		Genres:            a.Genres,
+		Tags:              a.Tags,
+		Stock:             int32(a.Stock),
+		LowStockThreshold: int32(a.LowStockThreshold),
+		CreateTime:        timestamppb.New(a.CreatedAt),
+		UpdateTime:        timestamppb.New(a.UpdatedAt),
+	}
+	if a.Cover != "" {
+		m.CoverUrl = coverURL(a.Cover, "full")
+	}
+	return m
+}
+
+// albumInputValues reads an AlbumInput as if it were a form. Unset fields
+// count as not sent.
+func albumInputValues(in *albumpb.AlbumInput) albumValues {
+	if in == nil {
+		in = &albumpb.AlbumInput{}
+	}
+	optional := func(v *string) (string, bool) {
+		if v == nil {
+			return "", false
+		}
+		return *v, true
+	}
+	return func(name string) (string, bool) {
+		switch name {
+		case "title":
+			return optional(in.Title)
+		case "artist":
+			return optional(in.Artist)
+		case "price":
+			if in.Price == nil {
+				return "", false
+			}
+			return strconv.FormatFloat(*in.Price, 'f', -1, 64), true
+		case "year":
+			if in.Year == nil {
+				return "", false
+			}
+			if *in.Year == 0 {
+				return "", true
+			}
+			return strconv.Itoa(int(*in.Year)), true
+		case "label":
+			return optional(in.Label)
+		case "format":
+			return optional(in.Format)
+		case "catalog_number":
+			return optional(in.CatalogNumber)
+		case "barcode":
+			return optional(in.Barcode)
+		case "genres":
+			if in.Genres == nil {
+				return "", false
+			}
+			return strings.Join(in.Genres.Names, ","), true
+		case "tags":
+			if in.Tags == nil {
+				return "", false
+			}
+			return strings.Join(in.Tags.Names, ","), true
+		case "remove_cover":
+			if in.RemoveCover {
+				return "true", true
+			}
+		}
+		return "", false
+	}
+}
+
+// albumStatus is albumWriteError for gRPC.
+func albumStatus(err error) error {
+	var conflictErr albumConflict
+	var invalid invalidAlbum
+	switch {
+	case errors.Is(err, errAlbumNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.As(err, &conflictErr):
+		return status.Errorf(codes.Aborted, "%v; it is now at version %d", err, conflictErr.current.Version)
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if msg, ok := releaseConflict(err); ok {
+		return status.Error(codes.AlreadyExists, msg)
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func validAlbumID(id string) error {
+	if _, err := strconv.Atoi(id); err != nil {
+		return status.Error(codes.NotFound, errAlbumNotFound.Error())
+	}
+	return nil
+}
+
+func (albumService) ListAlbums(ctx context.Context, req *albumpb.ListAlbumsRequest) (*albumpb.ListAlbumsResponse, error) {
+	size := int(req.PageSize)
+	switch {
+	case size < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size cannot be negative")
+	case size == 0:
+		size = defaultAlbumPage
+	case size > maxAlbumPage:
+		size = maxAlbumPage
+	}
+	f := req.GetFilter()
+	filter := browseFilter{
+		Genres:  f.GetGenres(),
+		Tags:    f.GetTags(),
+		Artists: f.GetArtistIds(),
+		Prices:  f.GetPrices(),
+		Formats: f.GetFormats(),
+		Decades: f.GetDecades(),
+	}
+	page, err := pageAlbums(ctx, filter, req.PageToken, size)
+	if errors.Is(err, errInvalidCursor) {
+		return nil, status.Error(codes.InvalidArgument, "invalid page_token")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &albumpb.ListAlbumsResponse{NextPageToken: page.next, TotalSize: int32(page.total)}
+	for _, a := range page.albums {
+		resp.Albums = append(resp.Albums, albumMessage(a))
+	}
+	return resp, nil
+}
+
+func (albumService) GetAlbum(ctx context.Context, req *albumpb.GetAlbumRequest) (*albumpb.Album, error) {
+	if err := validAlbumID(req.Id); err != nil {
+		return nil, err
+	}
+	a, err := fetchAlbum(req.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Error(codes.NotFound, errAlbumNotFound.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return albumMessage(a), nil
+}
+
+func (albumService) CreateAlbum(ctx context.Context, req *albumpb.CreateAlbumRequest) (*albumpb.Album, error) {
+	get := albumInputValues(req.Album)
+	var newAlbum album
+	if err := bindAlbumFields(get, &newAlbum); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	genres, tags, err := bindAlbumTerms(get)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = bindRelease(get, &newAlbum.release); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	created, err := createAlbum(ctx, callAuditor(ctx), newAlbum, genres, tags, nil)
+	if err != nil {
+		return nil, albumStatus(err)
+	}
+	return albumMessage(created), nil
+}
+
+func (albumService) UpdateAlbum(ctx context.Context, req *albumpb.UpdateAlbumRequest) (*albumpb.Album, error) {
+	if err := validAlbumID(req.Id); err != nil {
+		return nil, err
+	}
+	if req.Version == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "version is required")
+	}
+	get := albumInputValues(req.Album)
+	a := album{ID: req.Id}
+	if err := bindAlbumFields(get, &a); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	genres, tags, err := bindAlbumTerms(get)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	updated, err := updateAlbum(ctx, callAuditor(ctx), a, []int64{req.Version}, false, get, genres, tags, nil)
+	if err != nil {
+		return nil, albumStatus(err)
+	}
+	return albumMessage(updated), nil
+}
+
+func (albumService) DeleteAlbum(ctx context.Context, req *albumpb.DeleteAlbumRequest) (*albumpb.Album, error) {
+	if err := validAlbumID(req.Id); err != nil {
+		return nil, err
+	}
+	if req.Version == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "version is required")
+	}
+	deleted, err := deleteAlbum(ctx, callAuditor(ctx), req.Id, []int64{req.Version}, false)
+	if err != nil {
+		return nil, albumStatus(err)
+	}
+	return albumMessage(deleted), nil
+}
+
+var changeKinds = map[string]albumpb.AlbumChange_Kind{
+	"created": albumpb.AlbumChange_CREATED,
+	"updated": albumpb.AlbumChange_UPDATED,
+	"deleted": albumpb.AlbumChange_DELETED,
+}
+
+// WatchAlbums follows the changes feed for as long as the caller stays,
+// sending what is already there and then waiting for more the way a
+// long-poll of getChanges does.
+func (albumService) WatchAlbums(req *albumpb.WatchAlbumsRequest, stream albumpb.AlbumService_WatchAlbumsServer) error {
+	ctx := stream.Context()
+	// Subscribing before the first read means a change committed in
+	// between still wakes the wait.
+	events, unsubscribe := albumEvents.Subscribe()
+	defer unsubscribe()
+
+	cursor, err := changesCursor(req.Cursor)
+	switch {
+	case errors.Is(err, errInvalidChangesCursor):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errChangesPruned):
+		return status.Error(codes.OutOfRange, err.Error())
+	case err != nil:
+		return status.Error(codes.Internal, err.Error())
+	}
+	for {
+		page, err := readChanges(cursor, maxChangesLimit)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		for _, ch := range page.Changes {
+			msg := &albumpb.AlbumChange{
+				Cursor:     ch.Cursor,
+				Kind:       changeKinds[ch.Kind],
+				AlbumId:    ch.AlbumID,
+				ChangeTime: timestamppb.New(ch.ChangedAt),
+			}
+			if ch.Album != nil {
+				msg.Album = albumMessage(*ch.Album)
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+		if cursor, err = strconv.ParseInt(page.Next, 10, 64); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if page.More {
+			continue
+		}
+		select {
+		case <-events:
+		case <-serverClosing:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
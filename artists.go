@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type artist struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Bio     string        `json:"bio"`
+	Aliases []artistAlias `json:"aliases,omitempty"`
+
+	AlbumCount int     `json:"album_count"`
+	TotalValue float64 `json:"total_value"`
+}
+
+type artistAlias struct {
+	ID    string `json:"id"`
+	Alias string `json:"alias"`
+}
+
+// artistSuggestionLimit caps the autocomplete list.
+const artistSuggestionLimit = 10
+
+// normalizeArtistName trims a name and collapses runs of whitespace, which
+// is all that is needed before the case-insensitive lookups.
+func normalizeArtistName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// likePattern escapes s for use inside an ILIKE pattern.
+func likePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// resolveArtist finds the artist a free-text name refers to, matching the
+// canonical name or any alias regardless of case, and creates one if there
+// is none yet.
+func resolveArtist(tx *sql.Tx, name string) (artist, error) {
+	name = normalizeArtistName(name)
+	var a artist
+	if name == "" {
+		return a, errors.New("artist is required")
+	}
+	err := tx.QueryRow(`
+        SELECT id, name FROM artists WHERE lower(name) = lower($1)
+        UNION ALL
+        SELECT artists.id, artists.name
+        FROM artist_aliases JOIN artists ON artists.id = artist_aliases.artist_id
+        WHERE lower(artist_aliases.alias) = lower($1)
+        LIMIT 1`, name).Scan(&a.ID, &a.Name)
+	if err != sql.ErrNoRows {
+		return a, err
+	}
+
+	// Another request may be creating the same artist; the no-op update
+	// makes RETURNING give us its row either way.
+	err = tx.QueryRow(`
+        INSERT INTO artists (name) VALUES ($1)
+        ON CONFLICT ((lower(name))) DO UPDATE SET name = artists.name
+        RETURNING id, name`, name).Scan(&a.ID, &a.Name)
+	return a, err
+}
+
+func fetchArtist(id string) (artist, error) {
+	var a artist
+	err := db.QueryRow(`
+        SELECT artists.id, artists.name, artists.bio, count(albums.id), COALESCE(sum(albums.price), 0)
+        FROM artists LEFT JOIN albums ON albums.artist_id = artists.id AND albums.deleted_at IS NULL
+        WHERE artists.id = $1
+        GROUP BY artists.id`, id).Scan(&a.ID, &a.Name, &a.Bio, &a.AlbumCount, &a.TotalValue)
+	if err != nil {
+		return a, err
+	}
+
+	rows, err := db.Query("SELECT id, alias FROM artist_aliases WHERE artist_id = $1 ORDER BY lower(alias)", id)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alias artistAlias
+		if err := rows.Scan(&alias.ID, &alias.Alias); err != nil {
+			return a, err
+		}
+		a.Aliases = append(a.Aliases, alias)
+	}
+	return a, rows.Err()
+}
+
+func getArtists(c *gin.Context) {
+	rows, err := db.Query(`
+        SELECT artists.id, artists.name, artists.bio, count(albums.id), COALESCE(sum(albums.price), 0)
+        FROM artists LEFT JOIN albums ON albums.artist_id = artists.id AND albums.deleted_at IS NULL
+        GROUP BY artists.id
+        ORDER BY lower(artists.name)`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var artists []artist
+	for rows.Next() {
+		var a artist
+		if err := rows.Scan(&a.ID, &a.Name, &a.Bio, &a.AlbumCount, &a.TotalValue); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		artists = append(artists, a)
+	}
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if responseVariant(c) == "json" {
+		c.JSON(http.StatusOK, artists)
+		return
+	}
+	render(c, 200, ArtistsPage(artists))
+}
+
+func getArtistByID(c *gin.Context) {
+	a, err := fetchArtist(c.Param("artistID"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "artist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE artist_id = $1 AND deleted_at IS NULL ORDER BY lower(title)", a.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if responseVariant(c) == "json" {
+		c.JSON(http.StatusOK, gin.H{"artist": a, "albums": albums})
+		return
+	}
+	render(c, 200, ArtistPage(a, albums))
+}
+
+// updateArtistByID changes an artist's canonical name and bio. Albums keep
+// a copy of the name, so a rename rewrites theirs as well.
+func updateArtistByID(c *gin.Context) {
+	id := c.Param("artistID")
+	name := normalizeArtistName(c.PostForm("name"))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	bio := strings.TrimSpace(c.PostForm("bio"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	err = tx.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM artists WHERE lower(name) = lower($1) AND id <> $2)
+            OR EXISTS (SELECT 1 FROM artist_aliases WHERE lower(alias) = lower($1) AND artist_id <> $2)`,
+		name, id).Scan(&taken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "another artist already has that name"})
+		return
+	}
+
+	res, err := tx.Exec("UPDATE artists SET name = $1, bio = $2 WHERE id = $3", name, bio, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "artist not found"})
+		return
+	}
+
+	before, err := queryAlbums(tx, "SELECT "+albumColumns+" FROM albums WHERE artist_id = $1 AND artist <> $2 FOR UPDATE", id, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, b := range before {
+		after, err := scanAlbum(tx.QueryRow(`
+            UPDATE albums SET artist = $1, updated_at = now(), version = version + 1
+            WHERE id = $2
+            RETURNING `+albumColumns, name, b.ID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err = recordAudit(tx, c, "update", &b, &after); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	a, err := fetchArtist(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, ArtistHeader(a))
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func postArtistAlias(c *gin.Context) {
+	id := c.Param("artistID")
+	alias := normalizeArtistName(c.PostForm("alias"))
+	if alias == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "alias is required"})
+		return
+	}
+
+	// An alias may not shadow another artist's canonical name either, or
+	// resolveArtist would have two answers for it.
+	res, err := db.Exec(`
+        INSERT INTO artist_aliases (artist_id, alias)
+        SELECT $1::integer, $2::text
+        WHERE NOT EXISTS (SELECT 1 FROM artists WHERE lower(name) = lower($2) AND id <> $1::integer)`,
+		id, alias)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23505": // unique_violation
+			c.JSON(http.StatusConflict, gin.H{"error": "that alias is already in use"})
+			return
+		case "23503": // foreign_key_violation
+			c.JSON(http.StatusNotFound, gin.H{"error": "artist not found"})
+			return
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "that alias is another artist's name"})
+		return
+	}
+	artistAliasesResponse(c, id)
+}
+
+func deleteArtistAlias(c *gin.Context) {
+	id := c.Param("artistID")
+	_, err := db.Exec("DELETE FROM artist_aliases WHERE id = $1 AND artist_id = $2", c.Param("aliasID"), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	artistAliasesResponse(c, id)
+}
+
+func artistAliasesResponse(c *gin.Context, id string) {
+	a, err := fetchArtist(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "artist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, ArtistAliases(a))
+		return
+	}
+	c.JSON(http.StatusOK, a.Aliases)
+}
+
+// suggestArtists feeds the artist autocomplete. The input sends its value
+// as artist; API clients may use q.
+func suggestArtists(c *gin.Context) {
+	q := normalizeArtistName(c.DefaultQuery("q", c.Query("artist")))
+	var names []string
+	if q != "" {
+		rows, err := db.Query(`
+            SELECT name FROM artists
+            WHERE name ILIKE '%' || $1 || '%'
+               OR id IN (SELECT artist_id FROM artist_aliases WHERE alias ILIKE '%' || $1 || '%')
+            ORDER BY lower(name) NOT LIKE lower($1) || '%', lower(name)
+            LIMIT $2`, likePattern(q), artistSuggestionLimit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			names = append(names, name)
+		}
+		if err = rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, ArtistSuggestions(names))
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// audioTags is what import-library reads from one audio file. Numbers are
+// zero and strings empty when a file does not say.
+type audioTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genres      []string
+	Label       string
+	ISRC        string
+	Year        int
+	Track       int
+	Disc        int
+	Duration    int // seconds
+}
+
+var errNoTags = errors.New("not an MP3 with ID3v2 tags, FLAC or Ogg file")
+
+// readAudioTags reads the tags of an MP3 (ID3v2), FLAC or Ogg Vorbis/Opus
+// file, telling them apart by content rather than extension.
+func readAudioTags(path string) (audioTags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return audioTags{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return audioTags{}, err
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return audioTags{}, errNoTags
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return audioTags{}, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		return readID3(f, info.Size())
+	case bytes.Equal(magic, []byte("fLaC")):
+		return readFLAC(f)
+	case bytes.Equal(magic, []byte("OggS")):
+		return readOgg(f, info.Size())
+	}
+	return audioTags{}, errNoTags
+}
+
+// setVorbisField applies one Vorbis comment, as found in FLAC and Ogg
+// files, to t.
+func (t *audioTags) setVorbisField(key, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	switch strings.ToUpper(key) {
+	case "TITLE":
+		t.Title = value
+	case "ARTIST":
+		t.Artist = value
+	case "ALBUMARTIST", "ALBUM ARTIST", "ALBUM_ARTIST":
+		t.AlbumArtist = value
+	case "ALBUM":
+		t.Album = value
+	case "GENRE":
+		t.Genres = append(t.Genres, value)
+	case "LABEL", "ORGANIZATION", "PUBLISHER":
+		t.Label = value
+	case "ISRC":
+		t.ISRC = value
+	case "DATE", "YEAR", "ORIGINALDATE":
+		if t.Year == 0 {
+			t.Year = leadingYear(value)
+		}
+	case "TRACKNUMBER":
+		t.Track = leadingNumber(value)
+	case "DISCNUMBER":
+		t.Disc = leadingNumber(value)
+	}
+}
+
+// leadingNumber reads numbers such as "3" or "3/12".
+func leadingNumber(s string) int {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
+// leadingYear reads the year from dates such as "1971" or "1971-03-05".
+func leadingYear(s string) int {
+	if len(s) < 4 {
+		return 0
+	}
+	n, _ := strconv.Atoi(s[:4])
+	return n
+}
+
+// ID3v2
+
+// id3v22Frames maps the three-letter frame IDs of ID3v2.2 to their later
+// names.
+var id3v22Frames = map[string]string{
+	"TT2": "TIT2", "TP1": "TPE1", "TP2": "TPE2", "TAL": "TALB", "TRK": "TRCK",
+	"TPA": "TPOS", "TYE": "TYER", "TCO": "TCON", "TPB": "TPUB", "TRC": "TSRC",
+	"TLE": "TLEN",
+}
+
+func readID3(f io.ReadSeeker, fileSize int64) (audioTags, error) {
+	var t audioTags
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return t, err
+	}
+	major, flags := header[3], header[5]
+	if major < 2 || major > 4 {
+		return t, fmt.Errorf("unsupported ID3v2.%d tag", major)
+	}
+	size := synchsafe(header[6:10])
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return t, err
+	}
+	audioStart := int64(10 + size)
+	if major == 4 && flags&0x10 != 0 {
+		audioStart += 10 // footer
+	}
+
+	// Before 2.4, unsynchronisation applies to the whole tag at once.
+	if flags&0x80 != 0 && major < 4 {
+		data = removeUnsync(data)
+	}
+	pos := 0
+	if flags&0x40 != 0 && len(data) >= 4 {
+		if major == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(data))
+		} else {
+			pos = synchsafe(data[:4])
+		}
+	}
+
+	lengthMillis := 0
+	for {
+		var id string
+		var frameSize, headerSize int
+		var formatFlags byte
+		if major == 2 {
+			if pos+6 > len(data) {
+				break
+			}
+			id = id3v22Frames[string(data[pos:pos+3])]
+			frameSize = int(data[pos+3])<<16 | int(data[pos+4])<<8 | int(data[pos+5])
+			headerSize = 6
+		} else {
+			if pos+10 > len(data) {
+				break
+			}
+			id = string(data[pos : pos+4])
+			if major == 4 {
+				frameSize = synchsafe(data[pos+4 : pos+8])
+			} else {
+				frameSize = int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+			}
+			formatFlags = data[pos+9]
+			headerSize = 10
+		}
+		if data[pos] == 0 || frameSize <= 0 || pos+headerSize+frameSize > len(data) {
+			break // padding, or a damaged frame
+		}
+		frame := data[pos+headerSize : pos+headerSize+frameSize]
+		pos += headerSize + frameSize
+
+		if major == 3 && formatFlags&0xc0 != 0 {
+			continue // compressed or encrypted
+		}
+		if major == 4 {
+			if formatFlags&0x0c != 0 {
+				continue
+			}
+			if formatFlags&0x01 != 0 && len(frame) >= 4 {
+				frame = frame[4:] // data length indicator
+			}
+			if formatFlags&0x02 != 0 {
+				frame = removeUnsync(frame)
+			}
+		}
+		if !strings.HasPrefix(id, "T") || len(frame) == 0 {
+			continue
+		}
+
+		values := id3Text(frame)
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		switch id {
+		case "TIT2":
+			t.Title = value
+		case "TPE1":
+			t.Artist = value
+		case "TPE2":
+			t.AlbumArtist = value
+		case "TALB":
+			t.Album = value
+		case "TRCK":
+			t.Track = leadingNumber(value)
+		case "TPOS":
+			t.Disc = leadingNumber(value)
+		case "TYER", "TDRC", "TDOR":
+			if t.Year == 0 {
+				t.Year = leadingYear(value)
+			}
+		case "TCON":
+			for _, v := range values {
+				t.Genres = append(t.Genres, id3Genre(v)...)
+			}
+		case "TPUB":
+			t.Label = value
+		case "TSRC":
+			t.ISRC = value
+		case "TLEN":
+			lengthMillis, _ = strconv.Atoi(value)
+		}
+	}
+
+	if lengthMillis > 0 {
+		t.Duration = (lengthMillis + 500) / 1000
+	} else {
+		t.Duration = mp3Duration(f, audioStart, fileSize)
+	}
+	return t, nil
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// removeUnsync undoes ID3 unsynchronisation, which inserts a zero after
+// every 0xFF byte.
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xff && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// id3Text decodes a text frame. ID3v2.4 separates multiple values with
+// NULs.
+func id3Text(frame []byte) []string {
+	enc, b := frame[0], frame[1:]
+	var s string
+	switch enc {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	case 1, 2: // UTF-16 with a byte order mark, UTF-16BE
+		s = decodeUTF16(b, enc == 2)
+	default: // UTF-8
+		s = string(b)
+	}
+	var values []string
+	for _, v := range strings.Split(s, "\x00") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	var units []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		switch {
+		case b[i] == 0xff && b[i+1] == 0xfe:
+			bigEndian = false
+			continue
+		case b[i] == 0xfe && b[i+1] == 0xff:
+			bigEndian = true
+			continue
+		}
+		if bigEndian {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			units = append(units, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// id3v1Genres are the numbered genres older taggers write as "(17)".
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// id3Genre expands genre references such as "(17)", "(17)Rock" or "17".
+func id3Genre(v string) []string {
+	var genres []string
+	for strings.HasPrefix(v, "(") {
+		ref, rest, ok := strings.Cut(v[1:], ")")
+		if !ok {
+			break
+		}
+		if n, err := strconv.Atoi(ref); err == nil && n < len(id3v1Genres) {
+			genres = append(genres, id3v1Genres[n])
+		}
+		v = rest
+	}
+	if n, err := strconv.Atoi(v); err == nil && n < len(id3v1Genres) {
+		return append(genres, id3v1Genres[n])
+	}
+	if v = strings.TrimSpace(v); v != "" && len(genres) == 0 {
+		genres = append(genres, v)
+	}
+	return genres
+}
+
+// mp3Duration works out an MP3's length from its first frame: exactly from
+// a Xing/Info or VBRI header, otherwise by assuming a constant bitrate.
+// Only Layer III is understood; anything else gives zero.
+func mp3Duration(f io.ReadSeeker, audioStart, fileSize int64) int {
+	if _, err := f.Seek(audioStart, io.SeekStart); err != nil {
+		return 0
+	}
+	buf := make([]byte, 64<<10)
+	n, _ := io.ReadFull(f, buf)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xff || buf[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := buf[i+1] >> 3 & 3 // 3 = MPEG-1, 2 = MPEG-2, 0 = MPEG-2.5
+		layer := buf[i+1] >> 1 & 3   // 1 = Layer III
+		bitrateIndex := buf[i+2] >> 4
+		rateIndex := buf[i+2] >> 2 & 3
+		if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+		mono := buf[i+3]>>6 == 3
+
+		var bitrate, sampleRate, samplesPerFrame, sideInfo int
+		if version == 3 {
+			bitrate = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}[bitrateIndex]
+			sampleRate = []int{44100, 48000, 32000}[rateIndex]
+			samplesPerFrame = 1152
+			sideInfo = 32
+			if mono {
+				sideInfo = 17
+			}
+		} else {
+			bitrate = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}[bitrateIndex]
+			sampleRate = []int{22050, 24000, 16000}[rateIndex]
+			if version == 0 {
+				sampleRate /= 2
+			}
+			samplesPerFrame = 576
+			sideInfo = 17
+			if mono {
+				sideInfo = 9
+			}
+		}
+
+		frames := 0
+		if x := i + 4 + sideInfo; x+12 <= len(buf) {
+			tag := string(buf[x : x+4])
+			if (tag == "Xing" || tag == "Info") && buf[x+7]&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buf[x+8:]))
+			}
+		}
+		if v := i + 4 + 32; frames == 0 && v+18 <= len(buf) && string(buf[v:v+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buf[v+14:]))
+		}
+		if frames > 0 {
+			return frames * samplesPerFrame / sampleRate
+		}
+		return int((fileSize - audioStart - int64(i)) * 8 / int64(bitrate*1000))
+	}
+	return 0
+}
+
+// FLAC
+
+func readFLAC(f io.ReadSeeker) (audioTags, error) {
+	var t audioTags
+	if _, err := f.Seek(4, io.SeekStart); err != nil {
+		return t, err
+	}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return t, err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		switch kind {
+		case 0, 4: // STREAMINFO, VORBIS_COMMENT
+			block := make([]byte, length)
+			if _, err := io.ReadFull(f, block); err != nil {
+				return t, err
+			}
+			if kind == 0 && len(block) >= 18 {
+				sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+				samples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+				if sampleRate > 0 {
+					t.Duration = int((samples + int64(sampleRate)/2) / int64(sampleRate))
+				}
+			} else if kind == 4 {
+				if err := parseVorbisComments(block, &t); err != nil {
+					return t, err
+				}
+			}
+		default: // pictures, seek tables and padding
+			if _, err := f.Seek(int64(length), io.SeekCurrent); err != nil {
+				return t, err
+			}
+		}
+		if last {
+			return t, nil
+		}
+	}
+}
+
+// parseVorbisComments reads a comment block: a vendor string, then a count
+// of KEY=value strings, all lengths little-endian.
+func parseVorbisComments(b []byte, t *audioTags) error {
+	errShort := errors.New("truncated Vorbis comment block")
+	next := func() (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n) > uint64(len(b)-4) {
+			return "", false
+		}
+		s := string(b[4 : 4+n])
+		b = b[4+n:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // vendor
+		return errShort
+	}
+	if len(b) < 4 {
+		return errShort
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return errShort
+		}
+		if key, value, ok := strings.Cut(comment, "="); ok {
+			t.setVorbisField(key, value)
+		}
+	}
+	return nil
+}
+
+// Ogg
+
+// oggPage is the part of an Ogg page header we need.
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte
+}
+
+func readOggPage(r io.Reader) (oggPage, error) {
+	var p oggPage
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return p, err
+	}
+	if string(header[:4]) != "OggS" {
+		return p, errors.New("lost Ogg page sync")
+	}
+	p.granule = int64(binary.LittleEndian.Uint64(header[6:14]))
+	p.serial = binary.LittleEndian.Uint32(header[14:18])
+	p.segments = make([]byte, header[26])
+	_, err := io.ReadFull(r, p.segments)
+	return p, err
+}
+
+// readOgg reads the identification and comment packets of the first
+// logical stream, then the last page's granule position for the length.
+func readOgg(f io.ReadSeeker, fileSize int64) (audioTags, error) {
+	var t audioTags
+	var packets [][]byte
+	var packet []byte
+	var serial uint32
+	for pages := 0; len(packets) < 2; pages++ {
+		page, err := readOggPage(f)
+		if err != nil {
+			return t, err
+		}
+		if pages == 0 {
+			serial = page.serial
+		}
+		for _, n := range page.segments {
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(f, chunk); err != nil {
+				return t, err
+			}
+			if page.serial != serial {
+				continue
+			}
+			packet = append(packet, chunk...)
+			// A segment shorter than 255 bytes ends a packet.
+			if n < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	id, comments := packets[0], packets[1]
+	var sampleRate, preSkip int64
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")) && len(id) >= 16:
+		sampleRate = int64(binary.LittleEndian.Uint32(id[12:16]))
+		if !bytes.HasPrefix(comments, []byte("\x03vorbis")) {
+			return t, errors.New("missing Vorbis comment header")
+		}
+		comments = comments[7:]
+	case bytes.HasPrefix(id, []byte("OpusHead")) && len(id) >= 12:
+		// Opus granule positions always count 48 kHz samples.
+		sampleRate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(id[10:12]))
+		if !bytes.HasPrefix(comments, []byte("OpusTags")) {
+			return t, errors.New("missing Opus tags")
+		}
+		comments = comments[8:]
+	default:
+		return t, errors.New("Ogg file is neither Vorbis nor Opus")
+	}
+	if err := parseVorbisComments(comments, &t); err != nil {
+		return t, err
+	}
+
+	// The last page of the stream says how many samples came before it.
+	tail := min(fileSize, 64<<10)
+	if _, err := f.Seek(-tail, io.SeekEnd); err != nil {
+		return t, nil
+	}
+	buf := make([]byte, tail)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return t, nil
+	}
+	for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+		page, err := readOggPage(bytes.NewReader(buf[i:]))
+		if err == nil && page.serial == serial && page.granule > 0 && sampleRate > 0 {
+			// A broken stream can end before its pre-skip does.
+			t.Duration = int(max(0, (page.granule-preSkip+sampleRate/2)/sampleRate))
+			break
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditPageSize is how many entries the global audit feed shows at a time.
+const auditPageSize = 50
+
+// auditActions are the values album_audit.action can take.
+var auditActions = []string{"create", "update", "delete", "restore", "purge"}
+
+type auditEntry struct {
+	ID        int64     `json:"id"`
+	AlbumID   string    `json:"album_id"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id"`
+	Before    *album    `json:"before"`
+	After     *album    `json:"after"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type fieldChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// Changes lists the fields that differ between Before and After. Creates
+// and purges compare against an empty album.
+func (e auditEntry) Changes() []fieldChange {
+	before, after := auditFields(e.Before), auditFields(e.After)
+	var changes []fieldChange
+	for i, field := range auditFieldNames {
+		if before[i] != after[i] {
+			changes = append(changes, fieldChange{Field: field, Before: before[i], After: after[i]})
+		}
+	}
+	return changes
+}
+
+var auditFieldNames = []string{"Title", "Artist", "Price", "Year", "Label", "Format", "Catalog number", "Barcode", "Cover", "Genres", "Tags", "Low stock threshold", "Deleted"}
+
+func auditFields(a *album) []string {
+	if a == nil {
+		return make([]string, len(auditFieldNames))
+	}
+	deleted := ""
+	if a.DeletedAt != nil {
+		deleted = "yes"
+	}
+	return []string{
+		a.Title, a.Artist, fmt.Sprintf("%.2f", a.Price),
+		yearValue(a.Year), a.Label, formatLabel(a.Format), a.CatalogNumber, a.Barcode, a.Cover,
+		strings.Join(a.Genres, ", "), strings.Join(a.Tags, ", "),
+		strconv.Itoa(a.LowStockThreshold), deleted,
+	}
+}
+
+// requestID tags every request with an ID, keeping one set by a proxy, so
+// audit entries can be matched up with access logs.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Set("requestID", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// trustedProxies are the addresses of the authenticating proxies, from
+// TRUSTED_PROXIES. Only requests arriving from one of them may name a user.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma-separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address", s)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forwardedUser drops the X-Forwarded-User header from requests that did
+// not come through a trusted proxy, so nobody can name themselves staff by
+// setting it.
+func forwardedUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("X-Forwarded-User") != "" && !fromTrustedProxy(c) {
+			c.Request.Header.Del("X-Forwarded-User")
+		}
+		c.Next()
+	}
+}
+
+func fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditActor names whoever made the request. There are no logins yet, so
+// this trusts the X-Forwarded-User header an authenticating proxy sets;
+// forwardedUser has already dropped it unless the proxy is trusted.
+func auditActor(c *gin.Context) string {
+	if user := c.GetHeader("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// auditor is who is behind a change: the actor and request the audit log
+// records it against.
+type auditor struct {
+	actor     string
+	requestID string
+}
+
+// requestAuditor is the auditor of changes made by a web request.
+func requestAuditor(c *gin.Context) auditor {
+	return auditor{actor: auditActor(c), requestID: c.GetString("requestID")}
+}
+
+// recordAudit appends an entry for a change to an album, and queues the
+// webhooks it sets off. It must run in the transaction that makes the
+// change so they all commit or fail together. c is nil for changes the
+// server makes on its own.
+func recordAudit(tx *sql.Tx, c *gin.Context, action string, before, after *album) error {
+	who := auditor{actor: "system"}
+	if c != nil {
+		who = requestAuditor(c)
+	}
+	return who.record(tx, action, before, after)
+}
+
+// record appends an audit entry for a change made by who, in tx, and
+// queues its webhooks, as recordAudit does.
+func (who auditor) record(tx *sql.Tx, action string, before, after *album) error {
+	var albumID string
+	var beforeJSON, afterJSON any
+	if before != nil {
+		albumID = before.ID
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		beforeJSON = string(b)
+	}
+	if after != nil {
+		albumID = after.ID
+		b, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		afterJSON = string(b)
+	}
+
+	_, err := tx.Exec(`INSERT INTO album_audit (album_id, action, actor, request_id, before, after) VALUES ($1, $2, $3, $4, $5, $6);`,
+		albumID, action, who.actor, who.requestID, beforeJSON, afterJSON)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, action, before, after)
+}
+
+type auditFilter struct {
+	AlbumID string
+	Action  string
+	Actor   string
+	Before  int64
+}
+
+// queryAudit returns matching entries, newest first. A limit of 0 returns
+// all of them.
+func queryAudit(f auditFilter, limit int) ([]auditEntry, error) {
+	var albumID any
+	if f.AlbumID != "" {
+		id, err := strconv.Atoi(f.AlbumID)
+		if err != nil {
+			return nil, err
+		}
+		albumID = id
+	}
+
+	rows, err := db.Query(`
+        SELECT id, album_id, action, actor, request_id, before, after, created_at
+        FROM album_audit
+        WHERE ($1::integer IS NULL OR album_id = $1::integer)
+          AND ($2 = '' OR action = $2)
+          AND ($3 = '' OR actor ILIKE '%' || $3 || '%')
+          AND ($4::bigint = 0 OR id < $4::bigint)
+        ORDER BY id DESC
+        LIMIT NULLIF($5, 0)`,
+		albumID, f.Action, f.Actor, f.Before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.AlbumID, &e.Action, &e.Actor, &e.RequestID, &before, &after, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before != nil {
+			if err := json.Unmarshal(before, &e.Before); err != nil {
+				return nil, err
+			}
+		}
+		if after != nil {
+			if err := json.Unmarshal(after, &e.After); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func getAlbumHistory(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := strconv.Atoi(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album id"})
+		return
+	}
+
+	entries, err := queryAudit(auditFilter{AlbumID: id}, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if responseVariant(c) == "json" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+	render(c, 200, AlbumHistoryPage(id, entries))
+}
+
+func getAuditFeed(c *gin.Context) {
+	f := auditFilter{
+		AlbumID: c.Query("album"),
+		Action:  c.Query("action"),
+		Actor:   c.Query("actor"),
+	}
+	if f.AlbumID != "" {
+		if _, err := strconv.Atoi(f.AlbumID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid album id"})
+			return
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		var err error
+		f.Before, err = strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+	}
+
+	entries, err := queryAudit(f, auditPageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A full page means there may be more, so link to the next one.
+	next := ""
+	if len(entries) == auditPageSize {
+		q := url.Values{}
+		q.Set("album", f.AlbumID)
+		q.Set("action", f.Action)
+		q.Set("actor", f.Actor)
+		q.Set("before", strconv.FormatInt(entries[len(entries)-1].ID, 10))
+		next = "/audit?" + q.Encode()
+	}
+
+	switch responseVariant(c) {
+	case "fragment":
+		if f.Before != 0 {
+			render(c, 200, AuditEntries(entries, next))
+			return
+		}
+		render(c, 200, AuditFeed(entries, next))
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"entries": entries, "next": next})
+	default:
+		render(c, 200, AuditPage(f, entries, next))
+	}
+}
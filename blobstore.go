@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// blobStore holds uploaded files such as cover art. Keys are slash-separated
+// paths made up by the caller.
+type blobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var blobs blobStore
+
+// newBlobStore picks the store from BLOB_STORE: "local" (the default) keeps
+// files under BLOB_DIR, "s3" talks to any S3-compatible service.
+func newBlobStore() (blobStore, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		return &localStore{dir: dir}, nil
+	case "s3":
+		return newS3Store(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+		)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+}
+
+// localStore keeps blobs as files in a directory.
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *localStore) Put(_ context.Context, key string, data []byte, _ string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see half a blob.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *localStore) Delete(_ context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3Store speaks just enough of the S3 API, signed with Signature Version
+// 4, to store blobs in a bucket. It uses path-style URLs, which MinIO and
+// other local stand-ins expect.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Store(endpoint, bucket, region, accessKey, secretKey string) (*s3Store, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	s := &s3Store{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	// Create the bucket on first use; a bucket we already own is fine.
+	resp, err := s.do(context.Background(), http.MethodPut, "", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return nil, fmt.Errorf("creating bucket %s: %s", bucket, resp.Status)
+	}
+	return s, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storing %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", key, resp.Status)
+	}
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// do sends a signed request for key in the bucket, or for the bucket itself
+// when key is empty.
+func (s *s3Store) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := method + "\n" +
+		u.EscapedPath() + "\n" +
+		"\n" + // no query string
+		"host:" + u.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		signedHeaders + "\n" +
+		payloadHash
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+
+	return s.client.Do(req)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
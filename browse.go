@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// termTable describes one of the many-to-many label tables on albums.
+type termTable struct {
+	table     string
+	joinTable string
+	column    string
+}
+
+var (
+	genreTerms = termTable{table: "genres", joinTable: "album_genres", column: "genre_id"}
+	tagTerms   = termTable{table: "tags", joinTable: "album_tags", column: "tag_id"}
+)
+
+// maxTermLength bounds a single genre or tag name.
+const maxTermLength = 50
+
+// parseTerms splits a comma-separated list of genres or tags, tidying
+// whitespace and dropping blanks and case-insensitive duplicates.
+func parseTerms(s string) ([]string, error) {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, term := range strings.Split(s, ",") {
+		term = normalizeArtistName(term)
+		if term == "" || seen[strings.ToLower(term)] {
+			continue
+		}
+		if len(term) > maxTermLength {
+			return nil, fmt.Errorf("%q is longer than %d characters", term, maxTermLength)
+		}
+		seen[strings.ToLower(term)] = true
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// setAlbumTerms replaces the genres or tags on an album, creating any names
+// not seen before. Names match case-insensitively.
+func setAlbumTerms(tx *sql.Tx, t termTable, albumID string, names []string) error {
+	if _, err := tx.Exec("DELETE FROM "+t.joinTable+" WHERE album_id = $1", albumID); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+        WITH terms AS (
+            INSERT INTO `+t.table+` (name) SELECT unnest($2::text[])
+            ON CONFLICT ((lower(name))) DO UPDATE SET name = `+t.table+`.name
+            RETURNING id
+        )
+        INSERT INTO `+t.joinTable+` (album_id, `+t.column+`) SELECT $1::integer, id FROM terms`,
+		albumID, pq.Array(names))
+	return err
+}
+
+// bindAlbumTerms reads the comma-separated genres and tags fields. A field
+// the request did not send comes back nil, meaning leave it alone.
+func bindAlbumTerms(get albumValues) (genres, tags []string, err error) {
+	if v, ok := get("genres"); ok {
+		if genres, err = parseTerms(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	if v, ok := get("tags"); ok {
+		if tags, err = parseTerms(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	return genres, tags, nil
+}
+
+type priceBand struct {
+	Key   string
+	Label string
+	Below float64 // 0 for the open-ended top band
+}
+
+// priceBands must be in ascending order with the open-ended band last.
+var priceBands = []priceBand{
+	{Key: "under-10", Label: "Under $10", Below: 10},
+	{Key: "10-20", Label: "$10 to $20", Below: 20},
+	{Key: "20-50", Label: "$20 to $50", Below: 50},
+	{Key: "50-up", Label: "$50 and up"},
+}
+
+// priceBandSQL evaluates to the key of the band an album's price is in.
+var priceBandSQL = func() string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for _, band := range priceBands[:len(priceBands)-1] {
+		fmt.Fprintf(&b, " WHEN albums.price < %g THEN '%s'", band.Below, band.Key)
+	}
+	fmt.Fprintf(&b, " ELSE '%s' END", priceBands[len(priceBands)-1].Key)
+	return b.String()
+}()
+
+// decadeSQL evaluates to the decade an album was released in, as "1970".
+const decadeSQL = `(albums.release_year / 10 * 10)::text`
+
+// browseFilter is the facet selection. Values within a facet are ORed and
+// the facets are ANDed.
+type browseFilter struct {
+	Genres  []string
+	Tags    []string
+	Artists []string
+	Prices  []string
+	Formats []string
+	Decades []string
+}
+
+// parseBrowseFilter reads the selection from the query string or, for the
+// undo button's POST, the body.
+func parseBrowseFilter(c *gin.Context) browseFilter {
+	c.Request.ParseForm()
+	form := c.Request.Form
+	return browseFilter{
+		Genres:  form["genre"],
+		Tags:    form["tag"],
+		Artists: form["artist"],
+		Prices:  form["price"],
+		Formats: form["format"],
+		Decades: form["decade"],
+	}
+}
+
+// values is the selection as parseBrowseFilter reads it.
+func (f browseFilter) values() url.Values {
+	v := url.Values{}
+	for name, values := range map[string][]string{
+		"genre": f.Genres, "tag": f.Tags, "artist": f.Artists,
+		"price": f.Prices, "format": f.Formats, "decade": f.Decades,
+	} {
+		if len(values) > 0 {
+			v[name] = values
+		}
+	}
+	return v
+}
+
+// EventsURL is the event stream for a grid showing the selection.
+func (f browseFilter) EventsURL() string {
+	if v := f.values(); len(v) > 0 {
+		return "/events?" + v.Encode()
+	}
+	return "/events"
+}
+
+// matches reports whether the album with the given ID is live and in the
+// selection.
+func (f browseFilter) matches(q querier, id string) (bool, error) {
+	where, args := f.where("")
+	args = append(args, id)
+	var ok bool
+	err := q.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM albums WHERE %s AND albums.id = $%d)", where, len(args)), args...).Scan(&ok)
+	return ok, err
+}
+
+func lowered(values []string) []string {
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strings.ToLower(v)
+	}
+	return out
+}
+
+// where builds the conditions for live albums matching f. Counting a facet
+// skips that facet's own selection, so its other values still show how many
+// albums they would add.
+func (f browseFilter) where(skip string) (string, []any) {
+	conds := []string{"albums.deleted_at IS NULL"}
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if skip != "genre" && len(f.Genres) > 0 {
+		add(`albums.id IN (SELECT album_genres.album_id FROM album_genres JOIN genres ON genres.id = album_genres.genre_id WHERE lower(genres.name) = ANY($%d))`, pq.Array(lowered(f.Genres)))
+	}
+	if skip != "tag" && len(f.Tags) > 0 {
+		add(`albums.id IN (SELECT album_tags.album_id FROM album_tags JOIN tags ON tags.id = album_tags.tag_id WHERE lower(tags.name) = ANY($%d))`, pq.Array(lowered(f.Tags)))
+	}
+	if skip != "artist" && len(f.Artists) > 0 {
+		add(`albums.artist_id::text = ANY($%d)`, pq.Array(f.Artists))
+	}
+	if skip != "price" && len(f.Prices) > 0 {
+		add(priceBandSQL+` = ANY($%d)`, pq.Array(f.Prices))
+	}
+	if skip != "format" && len(f.Formats) > 0 {
+		add(`albums.format = ANY($%d)`, pq.Array(f.Formats))
+	}
+	if skip != "decade" && len(f.Decades) > 0 {
+		add(decadeSQL+` = ANY($%d)`, pq.Array(f.Decades))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+type facet struct {
+	Value    string
+	Label    string
+	Count    int
+	Selected bool
+}
+
+type facets struct {
+	Genres  []facet
+	Tags    []facet
+	Artists []facet
+	Prices  []facet
+	Formats []facet
+	Decades []facet
+}
+
+// Any reports whether a facet value is selected.
+func (fs facets) Any() bool {
+	for _, group := range [][]facet{fs.Genres, fs.Tags, fs.Artists, fs.Prices, fs.Formats, fs.Decades} {
+		for _, f := range group {
+			if f.Selected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadFacets counts the albums behind each facet value with one grouped
+// query per facet. Values with no albums are left out unless selected, so
+// a selection can always be cleared.
+func loadFacets(f browseFilter) (facets, error) {
+	var fs facets
+	var err error
+
+	where, args := f.where("genre")
+	fs.Genres, err = queryFacets(f.Genres, `
+        SELECT genres.name, genres.name, count(albums.id)
+        FROM genres
+        JOIN album_genres ON album_genres.genre_id = genres.id
+        LEFT JOIN albums ON albums.id = album_genres.album_id AND `+where+`
+        GROUP BY genres.id
+        HAVING count(albums.id) > 0 OR lower(genres.name) = ANY($`+fmt.Sprint(len(args)+1)+`)
+        ORDER BY count(albums.id) DESC, lower(genres.name)`, append(args, pq.Array(lowered(f.Genres)))...)
+	if err != nil {
+		return fs, err
+	}
+
+	where, args = f.where("tag")
+	fs.Tags, err = queryFacets(f.Tags, `
+        SELECT tags.name, tags.name, count(albums.id)
+        FROM tags
+        JOIN album_tags ON album_tags.tag_id = tags.id
+        LEFT JOIN albums ON albums.id = album_tags.album_id AND `+where+`
+        GROUP BY tags.id
+        HAVING count(albums.id) > 0 OR lower(tags.name) = ANY($`+fmt.Sprint(len(args)+1)+`)
+        ORDER BY count(albums.id) DESC, lower(tags.name)`, append(args, pq.Array(lowered(f.Tags)))...)
+	if err != nil {
+		return fs, err
+	}
+
+	where, args = f.where("artist")
+	fs.Artists, err = queryFacets(f.Artists, `
+        SELECT artists.id::text, artists.name, count(albums.id)
+        FROM artists
+        LEFT JOIN albums ON albums.artist_id = artists.id AND `+where+`
+        GROUP BY artists.id
+        HAVING count(albums.id) > 0 OR artists.id::text = ANY($`+fmt.Sprint(len(args)+1)+`)
+        ORDER BY count(albums.id) DESC, lower(artists.name)`, append(args, pq.Array(f.Artists))...)
+	if err != nil {
+		return fs, err
+	}
+
+	where, args = f.where("price")
+	counts, err := queryFacets(f.Prices, `
+        SELECT `+priceBandSQL+`, '', count(*)
+        FROM albums
+        WHERE `+where+`
+        GROUP BY 1`, args...)
+	if err != nil {
+		return fs, err
+	}
+	// The bands are listed in price order rather than by count.
+	for _, band := range priceBands {
+		p := facet{Value: band.Key, Label: band.Label, Selected: slices.Contains(f.Prices, band.Key)}
+		for _, count := range counts {
+			if count.Value == band.Key {
+				p.Count = count.Count
+			}
+		}
+		if p.Count > 0 || p.Selected {
+			fs.Prices = append(fs.Prices, p)
+		}
+	}
+
+	where, args = f.where("format")
+	counts, err = queryFacets(f.Formats, `
+        SELECT albums.format, '', count(*)
+        FROM albums
+        WHERE `+where+` AND albums.format <> ''
+        GROUP BY 1`, args...)
+	if err != nil {
+		return fs, err
+	}
+	for _, format := range releaseFormats {
+		p := facet{Value: format.Key, Label: format.Label, Selected: slices.Contains(f.Formats, format.Key)}
+		for _, count := range counts {
+			if count.Value == format.Key {
+				p.Count = count.Count
+			}
+		}
+		if p.Count > 0 || p.Selected {
+			fs.Formats = append(fs.Formats, p)
+		}
+	}
+
+	where, args = f.where("decade")
+	fs.Decades, err = queryFacets(f.Decades, `
+        SELECT `+decadeSQL+`, `+decadeSQL+` || 's', count(*)
+        FROM albums
+        WHERE `+where+` AND albums.release_year IS NOT NULL
+        GROUP BY 1
+        ORDER BY 1 DESC`, args...)
+	if err != nil {
+		return fs, err
+	}
+	for _, decade := range f.Decades {
+		if !slices.ContainsFunc(fs.Decades, func(d facet) bool { return d.Value == decade }) {
+			fs.Decades = append(fs.Decades, facet{Value: decade, Label: decade + "s", Selected: true})
+		}
+	}
+	return fs, nil
+}
+
+// queryFacets reads value, label, count rows and marks the values that are
+// in selected.
+func queryFacets(selected []string, query string, args ...any) ([]facet, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []facet
+	for rows.Next() {
+		var f facet
+		if err := rows.Scan(&f.Value, &f.Label, &f.Count); err != nil {
+			return nil, err
+		}
+		for _, s := range selected {
+			if strings.EqualFold(s, f.Value) {
+				f.Selected = true
+			}
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
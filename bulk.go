@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/gin-gonic/gin"
+)
+
+// batchActions are what a batch can do to each album in it.
+var batchActions = []string{"delete", "tag", "set_artist", "adjust_price"}
+
+const (
+	// maxBatch caps how many albums one batch may touch.
+	maxBatch = 500
+	// maxBatchRequest caps the body of a batch: room for maxBatch ids,
+	// the tags or artist, and the facet form the bulk action bar sends.
+	maxBatchRequest = maxBatch*32 + 16<<10
+)
+
+var errBatchTooLarge = fmt.Errorf("a batch request must be at most %d KB", maxBatchRequest>>10)
+
+// batchRequest is a batch as JSON clients send it. Versions optionally
+// maps album ids to the version the client last saw; an album that has
+// changed since is left alone and reported as a conflict. With Atomic,
+// one failed album undoes the whole batch.
+type batchRequest struct {
+	Action   string           `json:"action"`
+	IDs      []string         `json:"ids"`
+	Versions map[string]int64 `json:"versions"`
+	Atomic   bool             `json:"atomic"`
+
+	// Tags are added to each album by "tag".
+	Tags []string `json:"tags"`
+	// Artist is what "set_artist" credits each album to.
+	Artist string `json:"artist"`
+	// "adjust_price" changes each price by Percent or by Amount, which may
+	// be negative.
+	Percent *float64 `json:"percent"`
+	Amount  *float64 `json:"amount"`
+}
+
+// batchItem is the outcome for one album of a batch.
+type batchItem struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // ok, not_found, conflict or error
+	Error  string `json:"error,omitempty"`
+	Album  *album `json:"album,omitempty"`
+}
+
+type batchResult struct {
+	Action    string      `json:"action"`
+	Committed bool        `json:"committed"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Items     []batchItem `json:"items"`
+}
+
+// batchFailure is an album the batch could not change, and why.
+type batchFailure struct {
+	status string
+	msg    string
+}
+
+func (f batchFailure) Error() string { return f.msg }
+
+// bindBatchRequest reads a batch from JSON, or from the bulk action bar,
+// whose fields are named so they do not clash with the facet form sent
+// along with it.
+func bindBatchRequest(c *gin.Context) (batchRequest, error) {
+	var req batchRequest
+	if c.ContentType() == gin.MIMEJSON {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return req, err
+		}
+	} else {
+		req.Action = c.PostForm("action")
+		req.IDs = c.PostFormArray("ids")
+		req.Atomic = c.PostForm("atomic") != ""
+		tags, err := parseTerms(c.PostForm("add_tags"))
+		if err != nil {
+			return req, err
+		}
+		req.Tags = tags
+		req.Artist = c.PostForm("new_artist")
+		if v := c.PostForm("price_change"); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return req, fmt.Errorf("invalid price change")
+			}
+			if c.PostForm("price_change_by") == "percent" {
+				req.Percent = &n
+			} else {
+				req.Amount = &n
+			}
+		}
+	}
+
+	if !slices.Contains(batchActions, req.Action) {
+		return req, fmt.Errorf("action must be one of %s", strings.Join(batchActions, ", "))
+	}
+	var ids []string
+	for _, id := range req.IDs {
+		if _, err := strconv.Atoi(id); err != nil {
+			return req, fmt.Errorf("invalid album id %q", id)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	req.IDs = ids
+	if len(req.IDs) == 0 {
+		return req, fmt.Errorf("no albums selected")
+	}
+	if len(req.IDs) > maxBatch {
+		return req, fmt.Errorf("a batch can have at most %d albums", maxBatch)
+	}
+
+	switch req.Action {
+	case "tag":
+		// JSON tags have not been through parseTerms yet.
+		tags, err := parseTerms(strings.Join(req.Tags, ","))
+		if err != nil {
+			return req, err
+		}
+		if len(tags) == 0 {
+			return req, fmt.Errorf("tags are required")
+		}
+		req.Tags = tags
+	case "set_artist":
+		req.Artist = normalizeArtistName(req.Artist)
+		if req.Artist == "" {
+			return req, fmt.Errorf("artist is required")
+		}
+	case "adjust_price":
+		if (req.Percent == nil) == (req.Amount == nil) {
+			return req, fmt.Errorf("give either a percent or an amount to change prices by")
+		}
+	}
+	return req, nil
+}
+
+// postBatch applies one action to many albums in a single transaction.
+// Each album gets its own savepoint, so one that cannot be changed is
+// reported and skipped while the rest go ahead, unless the batch is
+// atomic. Every change is audited, and sends its webhooks, as if made one
+// by one.
+func postBatch(c *gin.Context) {
+	req, err := bindBatchRequest(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var art artist
+	if req.Action == "set_artist" {
+		if art, err = resolveArtist(tx, req.Artist); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	res := batchResult{Action: req.Action, Items: []batchItem{}}
+	for _, id := range req.IDs {
+		if _, err = tx.Exec("SAVEPOINT batch_item"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		item := batchItem{ID: id, Status: "ok"}
+		a, err := applyBatchItem(c.Request.Context(), tx, requestAuditor(c), req, art, id)
+		if err == nil {
+			if _, err = tx.Exec("RELEASE SAVEPOINT batch_item"); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			item.Album = &a
+			res.Succeeded++
+		} else {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT batch_item"); rbErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": rbErr.Error()})
+				return
+			}
+			item.Status, item.Error = "error", err.Error()
+			if f, ok := err.(batchFailure); ok {
+				item.Status = f.status
+			}
+			res.Failed++
+		}
+		res.Items = append(res.Items, item)
+	}
+
+	status := http.StatusOK
+	if req.Atomic && res.Failed > 0 {
+		status = http.StatusConflict
+	} else {
+		if err = tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res.Committed = true
+	}
+
+	if c.GetHeader("HX-Request") != "true" {
+		c.JSON(status, res)
+		return
+	}
+	// The bar sends the facet selection, so the grid keeps its filter.
+	filter := parseBrowseFilter(c)
+	albums, err := listAlbums(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	fs, err := loadFacets(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// htmx leaves error responses unswapped, and the summary has to show.
+	render(c, http.StatusOK, templ.Join(AlbumsDiv(albums, filter), Facets(fs, true), BatchToast(res)))
+}
+
+// applyBatchItem makes the batch's change to one album, returning it as
+// it is afterwards. The change goes through the same store functions as a
+// single write, in the batch's transaction.
+func applyBatchItem(ctx context.Context, tx *sql.Tx, who auditor, req batchRequest, art artist, id string) (album, error) {
+	var versions []int64
+	anyVersion := true
+	if v, ok := req.Versions[id]; ok {
+		versions, anyVersion = []int64{v}, false
+	}
+	if req.Action == "delete" {
+		deleted, err := trashAlbum(tx, who, id, versions, anyVersion)
+		return deleted, batchItemError(err)
+	}
+
+	current, err := lockAlbum(tx, id)
+	if err == sql.ErrNoRows {
+		return album{}, batchItemError(errAlbumNotFound)
+	}
+	if err != nil {
+		return album{}, err
+	}
+	if !versionMatches(versions, anyVersion, current.Version) {
+		return album{}, batchItemError(albumConflict{current: current})
+	}
+
+	a := current
+	var tags []string
+	switch req.Action {
+	case "tag":
+		tags = slices.Clone(current.Tags)
+		for _, t := range req.Tags {
+			if !slices.ContainsFunc(tags, func(s string) bool { return strings.EqualFold(s, t) }) {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) == len(current.Tags) {
+			return current, nil
+		}
+	case "set_artist":
+		if current.ArtistID == art.ID && current.Artist == art.Name {
+			return current, nil
+		}
+		a.Artist = art.Name
+	case "adjust_price":
+		if req.Percent != nil {
+			a.Price = roundCents(current.Price * (1 + *req.Percent/100))
+		} else {
+			a.Price = roundCents(current.Price + *req.Amount)
+		}
+		if a.Price < 0 {
+			return album{}, batchFailure{"error", fmt.Sprintf("price would be %.2f", a.Price)}
+		}
+		if a.Price == current.Price {
+			return current, nil
+		}
+	}
+	// Nothing else is sent, so the release fields and cover are kept.
+	unchanged := func(string) (string, bool) { return "", false }
+	_, updated, err := saveAlbum(ctx, tx, who, a, versions, anyVersion, unchanged, nil, tags, nil)
+	return updated, batchItemError(err)
+}
+
+// batchItemError reports a store error the way a batch item shows it.
+func batchItemError(err error) error {
+	var conflict albumConflict
+	switch {
+	case errors.Is(err, errAlbumNotFound):
+		return batchFailure{"not_found", "album not found"}
+	case errors.As(err, &conflict):
+		return batchFailure{"conflict", "album has been modified"}
+	}
+	return err
+}
+
+// batchVerb says what a batch did, for the summary toast.
+func batchVerb(action string) string {
+	switch action {
+	case "delete":
+		return "Deleted"
+	case "tag":
+		return "Tagged"
+	case "set_artist":
+		return "Re-credited"
+	default:
+		return "Repriced"
+	}
+}
+
+// failures lists the albums a batch could not change, for the
+// summary toast.
+func (r batchResult) failures() []batchItem {
+	var failed []batchItem
+	for _, item := range r.Items {
+		if item.Status != "ok" {
+			failed = append(failed, item)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cachePolicy sets the Cache-Control and Vary headers for a route. Every
+// header that picks between representations (full page, htmx fragment,
+// JSON) must be listed in vary so caches keep them apart.
+func cachePolicy(cacheControl string, vary ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", cacheControl)
+		if len(vary) > 0 {
+			c.Header("Vary", strings.Join(vary, ", "))
+		}
+		c.Next()
+	}
+}
+
+// catalogState reports how many times the albums table has been written
+// and when it last was. A statement trigger keeps it current, so it costs
+// one row read regardless of catalog size.
+func catalogState() (revision int64, modified time.Time, err error) {
+	err = db.QueryRow("SELECT revision, modified_at FROM album_catalog_state").Scan(&revision, &modified)
+	return revision, modified, err
+}
+
+// notModified sets the validators for the response and reports whether the
+// request's conditional headers show the client already has it, in which
+// case it has answered 304. A zero modified time omits Last-Modified.
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since when both are sent.
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		if !etagListMatches(header, etag) {
+			return false
+		}
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	if header := c.GetHeader("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		if err != nil || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagListMatches compares an If-None-Match header against etag using the
+// weak comparison RFC 9110 requires for it.
+func etagListMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	sessionCookie = "session"
+
+	// maxCartQuantity caps a single line of the cart.
+	maxCartQuantity = 99
+
+	// cartLifetime is how long an untouched cart is kept.
+	cartLifetime = 30 * 24 * time.Hour
+)
+
+// sessionID returns the visitor's session, which carts and orders belong
+// to. There are no accounts, so the session is the customer. A session is
+// only started when create is set, so merely browsing sets no cookie and
+// the catalog stays cacheable.
+func sessionID(c *gin.Context, create bool) string {
+	if id, err := c.Cookie(sessionCookie); err == nil && len(id) == 32 {
+		return id
+	}
+	if id := c.GetString("session"); id != "" {
+		return id
+	}
+	if !create {
+		return ""
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	c.Set("session", id)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, id, 365*24*60*60, "/", "", false, true)
+	return id
+}
+
+type cartItem struct {
+	Album    album `json:"album"`
+	Quantity int   `json:"quantity"`
+}
+
+// Subtotal is the line at the album's current price.
+func (i cartItem) Subtotal() float64 {
+	return i.Album.Price * float64(i.Quantity)
+}
+
+type cart struct {
+	Items []cartItem `json:"items"`
+}
+
+func (c cart) Count() int {
+	n := 0
+	for _, item := range c.Items {
+		n += item.Quantity
+	}
+	return n
+}
+
+func (c cart) Total() float64 {
+	total := 0.0
+	for _, item := range c.Items {
+		total += item.Subtotal()
+	}
+	return total
+}
+
+// loadCart reads a session's cart in the order things were added. Albums
+// that have been trashed drop out of it.
+func loadCart(q querier, session string) (cart, error) {
+	var ct cart
+	if session == "" {
+		return ct, nil
+	}
+	rows, err := q.Query("SELECT album_id, quantity FROM cart_items WHERE session_id = $1 ORDER BY added_at, album_id", session)
+	if err != nil {
+		return ct, err
+	}
+	defer rows.Close()
+	var ids []string
+	quantities := map[string]int{}
+	for rows.Next() {
+		var id string
+		var quantity int
+		if err := rows.Scan(&id, &quantity); err != nil {
+			return ct, err
+		}
+		ids = append(ids, id)
+		quantities[id] = quantity
+	}
+	if err = rows.Err(); err != nil {
+		return ct, err
+	}
+	if len(ids) == 0 {
+		return ct, nil
+	}
+
+	albums, err := queryAlbums(q, "SELECT "+albumColumns+" FROM albums WHERE id = ANY($1::integer[]) AND deleted_at IS NULL", pq.Array(ids))
+	if err != nil {
+		return ct, err
+	}
+	byID := map[string]album{}
+	for _, a := range albums {
+		byID[a.ID] = a
+	}
+	for _, id := range ids {
+		if a, ok := byID[id]; ok {
+			ct.Items = append(ct.Items, cartItem{Album: a, Quantity: quantities[id]})
+		}
+	}
+	return ct, nil
+}
+
+// parseCartQuantity reads the quantity field, defaulting to def when it is
+// absent.
+func parseCartQuantity(c *gin.Context, def int) (int, bool) {
+	v := strings.TrimSpace(c.PostForm("quantity"))
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > maxCartQuantity {
+		return 0, false
+	}
+	return n, true
+}
+
+func getCart(c *gin.Context) {
+	pr, err := priceCart(db, sessionID(c, false))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, CartView(pr))
+	case "json":
+		c.JSON(http.StatusOK, pr)
+	default:
+		render(c, 200, CartPage(pr))
+	}
+}
+
+// getCartCount is the cart link in the navigation, refreshed whenever the
+// cart changes.
+func getCartCount(c *gin.Context) {
+	var n int
+	if session := sessionID(c, false); session != "" {
+		err := db.QueryRow(`
+            SELECT COALESCE(sum(quantity), 0) FROM cart_items
+            JOIN albums ON albums.id = cart_items.album_id
+            WHERE session_id = $1 AND albums.deleted_at IS NULL`, session).Scan(&n)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	render(c, 200, CartLink(n))
+}
+
+// postCartItem adds copies of an album to the cart, on top of any already
+// in it.
+func postCartItem(c *gin.Context) {
+	albumID := c.PostForm("album_id")
+	quantity, ok := parseCartQuantity(c, 1)
+	if !ok || quantity == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quantity"})
+		return
+	}
+	setCartQuantity(c, albumID, quantity, true)
+}
+
+func updateCartItem(c *gin.Context) {
+	quantity, ok := parseCartQuantity(c, -1)
+	if !ok || quantity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quantity"})
+		return
+	}
+	if quantity == 0 {
+		deleteCartItem(c)
+		return
+	}
+	setCartQuantity(c, c.Param("albumID"), quantity, false)
+}
+
+// setCartQuantity sets the cart's quantity of an album, or adds to it.
+// It refuses more copies than are in stock; stock is only taken at
+// checkout, so this is a courtesy rather than a promise.
+func setCartQuantity(c *gin.Context, albumID string, quantity int, add bool) {
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	a, err := scanAlbum(tx.QueryRow("SELECT "+albumColumns+" FROM albums WHERE id = $1 AND deleted_at IS NULL", albumID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	session := sessionID(c, true)
+	update := "EXCLUDED.quantity"
+	if add {
+		update = "cart_items.quantity + EXCLUDED.quantity"
+	}
+	var total int
+	err = tx.QueryRow(`
+        INSERT INTO cart_items (session_id, album_id, quantity) VALUES ($1, $2, $3)
+        ON CONFLICT (session_id, album_id) DO UPDATE SET quantity = `+update+`
+        RETURNING quantity`, session, albumID, quantity).Scan(&total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if total > a.Stock {
+		c.JSON(http.StatusConflict, gin.H{"error": "only " + strconv.Itoa(a.Stock) + " in stock"})
+		return
+	}
+	if total > maxCartQuantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at most " + strconv.Itoa(maxCartQuantity) + " copies per album"})
+		return
+	}
+	if _, err = tx.Exec("UPDATE cart_items SET updated_at = now() WHERE session_id = $1", session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cartResponse(c, session, http.StatusOK)
+}
+
+func deleteCartItem(c *gin.Context) {
+	session := sessionID(c, false)
+	if session != "" {
+		_, err := db.Exec("DELETE FROM cart_items WHERE session_id = $1 AND album_id = $2", session, c.Param("albumID"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	cartResponse(c, session, http.StatusOK)
+}
+
+// cartResponse answers a change to the cart with the cart as priced now.
+// htmx gets the cart fragment and a cart-changed event for the navigation
+// link to pick up.
+func cartResponse(c *gin.Context, session string, status int) {
+	pr, err := priceCart(db, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		c.Header("HX-Trigger", "cart-changed")
+		render(c, status, CartView(pr))
+		return
+	}
+	c.JSON(status, pr)
+}
+
+// expireCarts forgets carts nobody has touched within cartLifetime, and
+// the codes entered for them.
+func expireCarts(ctx context.Context, _ struct{}) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM cart_items WHERE updated_at < now() - make_interval(secs => $1)", cartLifetime.Seconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Expired %d cart items", n)
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM cart_codes WHERE updated_at < now() - make_interval(secs => $1)", cartLifetime.Seconds())
+	return err
+}
+
+var expireCartsJob = registerJob("expire_carts", jobOptions{Every: purgeInterval}, expireCarts)
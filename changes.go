@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// defaultChangeRetention is how long the changes feed keeps a change when
+// CHANGE_RETENTION is not set. A consumer that falls further behind has
+// to sync the whole catalog again.
+const defaultChangeRetention = 7 * 24 * time.Hour
+
+// changeRetention is how long changes are kept, set from CHANGE_RETENTION
+// at startup.
+var changeRetention = defaultChangeRetention
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+
+	// maxChangesWait caps how long a long-poll may wait for a change.
+	maxChangesWait = 60 * time.Second
+)
+
+// feedChange is an entry of the changes feed. Album is the album as it is
+// now, which may be later than the change; it is null for tombstones, and
+// for albums that have since been deleted, whose tombstone follows.
+type feedChange struct {
+	Cursor    string    `json:"cursor"`
+	Kind      string    `json:"kind"`
+	AlbumID   string    `json:"album_id"`
+	ChangedAt time.Time `json:"changed_at"`
+	Album     *album    `json:"album"`
+}
+
+// changesPage is a response of the changes feed. Next is the cursor to
+// ask for next time; More says another request would return changes
+// straight away.
+type changesPage struct {
+	Changes []feedChange `json:"changes"`
+	Next    string       `json:"next"`
+	More    bool         `json:"more"`
+}
+
+// getChanges is the changes feed, for services that keep a copy of the
+// catalog. A consumer without a cursor gets an empty page with the current
+// one, fetches the catalog, then follows the feed from that cursor. Changes
+// come in the order they were committed. ?wait=<seconds> holds the request
+// open until there is a change or the time runs out, and ?limit= caps the
+// page. A cursor from before the retention period gets 410 Gone: the
+// consumer has missed changes and must start over.
+func getChanges(c *gin.Context) {
+	limit := defaultChangesLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangesLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxChangesLimit)})
+			return
+		}
+		limit = n
+	}
+	var wait time.Duration
+	if v := c.Query("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wait"})
+			return
+		}
+		wait = min(time.Duration(n)*time.Second, maxChangesWait)
+	}
+
+	since := c.Query("since")
+	cursor, err := changesCursor(since)
+	switch {
+	case errors.Is(err, errInvalidChangesCursor):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errChangesPruned):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if since == "" {
+		c.JSON(http.StatusOK, changesPage{Changes: []feedChange{}, Next: strconv.FormatInt(cursor, 10)})
+		return
+	}
+
+	// Subscribing before the first read means a change committed in
+	// between still wakes the wait.
+	var events <-chan albumEvent
+	if wait > 0 {
+		var unsubscribe func()
+		events, unsubscribe = albumEvents.Subscribe()
+		defer unsubscribe()
+	}
+	timeout := time.After(wait)
+	for {
+		page, err := readChanges(cursor, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(page.Changes) > 0 || wait == 0 {
+			c.JSON(http.StatusOK, page)
+			return
+		}
+		select {
+		case <-events:
+		case <-timeout:
+			c.JSON(http.StatusOK, page)
+			return
+		case <-serverClosing:
+			c.JSON(http.StatusOK, page)
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+var (
+	errInvalidChangesCursor = errors.New("Invalid cursor")
+	errChangesPruned        = errors.New("changes after that cursor are no longer kept; sync the catalog again")
+)
+
+// changesCursor checks a consumer's cursor is one the feed can still
+// resume from. An empty one stands for the current end of the feed.
+func changesCursor(since string) (int64, error) {
+	var latest, prunedThrough int64
+	err := db.QueryRow(`
+        SELECT COALESCE((SELECT max(id) FROM album_changes), 0), changes_pruned_through
+        FROM album_catalog_state`).Scan(&latest, &prunedThrough)
+	if err != nil {
+		return 0, err
+	}
+	if since == "" {
+		return max(latest, prunedThrough), nil
+	}
+	cursor, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || cursor < 0 {
+		return 0, errInvalidChangesCursor
+	}
+	if cursor < prunedThrough {
+		return 0, errChangesPruned
+	}
+	return cursor, nil
+}
+
+// readChanges reads up to limit changes after cursor, with the albums they
+// are about.
+func readChanges(cursor int64, limit int) (changesPage, error) {
+	page := changesPage{Changes: []feedChange{}, Next: strconv.FormatInt(cursor, 10)}
+	// One extra row says whether there are more.
+	rows, err := db.Query("SELECT id, kind, album_id, changed_at FROM album_changes WHERE id > $1 ORDER BY id LIMIT $2", cursor, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id int64
+		var ch feedChange
+		if err := rows.Scan(&id, &ch.Kind, &ch.AlbumID, &ch.ChangedAt); err != nil {
+			return page, err
+		}
+		ch.Cursor = strconv.FormatInt(id, 10)
+		page.Changes = append(page.Changes, ch)
+		if ch.Kind != "deleted" {
+			ids = append(ids, ch.AlbumID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Changes) > limit {
+		page.Changes, page.More = page.Changes[:limit], true
+	}
+	if len(page.Changes) > 0 {
+		page.Next = page.Changes[len(page.Changes)-1].Cursor
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE id = ANY($1::integer[]) AND deleted_at IS NULL", pq.Array(ids))
+	if err != nil {
+		return page, err
+	}
+	byID := map[string]*album{}
+	for i := range albums {
+		byID[albums[i].ID] = &albums[i]
+	}
+	for i, ch := range page.Changes {
+		if ch.Kind != "deleted" {
+			page.Changes[i].Album = byID[ch.AlbumID]
+		}
+	}
+	return page, nil
+}
+
+// pruneChanges drops changes older than changeRetention from the feed,
+// noting how far it got so stale cursors can be told apart from quiet
+// periods.
+func pruneChanges(ctx context.Context, _ struct{}) error {
+	res, err := db.ExecContext(ctx, `
+        WITH pruned AS (
+            DELETE FROM album_changes WHERE changed_at < now() - make_interval(secs => $1) RETURNING id
+        )
+        UPDATE album_catalog_state
+        SET changes_pruned_through = GREATEST(changes_pruned_through, (SELECT max(id) FROM pruned))
+        WHERE EXISTS (SELECT 1 FROM pruned)`, changeRetention.Seconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Pruned album changes older than %s", changeRetention)
+	}
+	return nil
+}
+
+var pruneChangesJob = registerJob("prune_changes", jobOptions{Every: purgeInterval}, pruneChanges)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // decoders for the accepted upload types
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxCoverBytes caps the uploaded file; the request as a whole may be a
+	// little larger to leave room for the other fields.
+	maxCoverBytes   = 10 << 20
+	maxAlbumRequest = maxCoverBytes + 1<<20
+
+	// maxCoverPixels guards against small files that decode to huge images.
+	maxCoverPixels = 50_000_000
+
+	coverThumbSize = 300
+	coverFullSize  = 1200
+)
+
+// coverTypes are the sniffed content types we can decode.
+var coverTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var (
+	errCoverTooLarge = fmt.Errorf("cover image must be at most %d MB", maxCoverBytes>>20)
+	errCoverType     = errors.New("cover image must be a JPEG, PNG or GIF")
+)
+
+// coverNamePattern matches the file names coverURL hands out.
+var coverNamePattern = regexp.MustCompile(`^[0-9a-f]{32}-(thumb|full)\.jpg$`)
+
+// coverImages is an upload resized to the sizes we serve, as JPEG.
+type coverImages struct {
+	thumb []byte
+	full  []byte
+}
+
+// limitBody rejects request bodies larger than n before any handler reads
+// them, answering with tooLarge.
+func limitBody(n int64, tooLarge error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > n {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": tooLarge.Error()})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
+
+// coverErrorStatus is the response status for an error from readCover.
+func coverErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCoverTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errCoverType):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// readCover reads and resizes the cover field of a multipart form. It
+// returns nil if no file was sent. The type is decided by sniffing the
+// content, not by the file name or the client's Content-Type.
+func readCover(c *gin.Context) (*coverImages, error) {
+	fh, err := c.FormFile("cover")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errCoverTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fh.Size > maxCoverBytes {
+		return nil, errCoverTooLarge
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxCoverBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCoverBytes {
+		return nil, errCoverTooLarge
+	}
+	if len(data) == 0 {
+		// An empty file input still sends a part.
+		return nil, nil
+	}
+
+	if !coverTypes[http.DetectContentType(data)] {
+		return nil, errCoverType
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errCoverType
+	}
+	if cfg.Width*cfg.Height > maxCoverPixels {
+		return nil, fmt.Errorf("cover image must be at most %d megapixels", maxCoverPixels/1_000_000)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errCoverType
+	}
+
+	full := resize(cropSquare(img), coverFullSize)
+	var out coverImages
+	if out.full, err = encodeJPEG(full); err != nil {
+		return nil, err
+	}
+	if out.thumb, err = encodeJPEG(resize(full, coverThumbSize)); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// cropSquare takes the largest centred square, which is the shape every
+// cover is shown in.
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	r := image.Rect(x, y, x+side, y+side)
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// resize scales a square image down to size pixels on a side by averaging
+// the source pixels behind each destination pixel. Smaller images are left
+// at their own size. Transparent areas come out white.
+func resize(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if side < size {
+		size = side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0 := b.Min.Y + dy*side/size
+		y1 := max(b.Min.Y+(dy+1)*side/size, y0+1)
+		for dx := 0; dx < size; dx++ {
+			x0 := b.Min.X + dx*side/size
+			x1 := max(b.Min.X+(dx+1)*side/size, x0+1)
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			// The colours are premultiplied, so adding the missing alpha
+			// as white composites onto a white background.
+			white := n*0xffff - a
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8((r + white) / n >> 8),
+				G: uint8((g + white) / n >> 8),
+				B: uint8((bl + white) / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	return buf.Bytes(), err
+}
+
+func newCoverKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func coverBlobKey(key, size string) string {
+	return "covers/" + key + "-" + size + ".jpg"
+}
+
+// coverURL is where the given size of a cover is served.
+func coverURL(key, size string) string {
+	return "/covers/" + key + "-" + size + ".jpg"
+}
+
+// saveCover stores both sizes of a cover under a new key. Keys are never
+// reused, so the files can be cached forever.
+func saveCover(ctx context.Context, img *coverImages) (string, error) {
+	key := newCoverKey()
+	if err := blobs.Put(ctx, coverBlobKey(key, "thumb"), img.thumb, "image/jpeg"); err != nil {
+		return "", err
+	}
+	if err := blobs.Put(ctx, coverBlobKey(key, "full"), img.full, "image/jpeg"); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// removeCover deletes a cover that no album refers to any more. Failures are
+// only logged; an orphaned file does no harm.
+func removeCover(key string) {
+	if key == "" {
+		return
+	}
+	for _, size := range []string{"thumb", "full"} {
+		if err := blobs.Delete(context.Background(), coverBlobKey(key, size)); err != nil {
+			log.Printf("Failed to delete cover %s: %v", key, err)
+		}
+	}
+}
+
+func getCover(c *gin.Context) {
+	name := c.Param("name")
+	if !coverNamePattern.MatchString(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cover not found"})
+		return
+	}
+	r, err := blobs.Get(c.Request.Context(), "covers/"+name)
+	if err != nil {
+		// Only a found cover is immutable.
+		c.Header("Cache-Control", "no-store")
+	}
+	if errors.Is(err, errBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cover not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer r.Close()
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, -1, "image/jpeg", r, nil)
+}
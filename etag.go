@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// albumETag identifies one revision of an album. The version column is
+// bumped on every write, so the tag changes whenever the row does.
+func albumETag(a album) string {
+	return fmt.Sprintf(`"%s-%d"`, a.ID, a.Version)
+}
+
+// albumViewETag tags one representation of an album for GET: the
+// revision, then whatever else the body depends on. Writes only look at
+// the revision, so any of these tags is good for If-Match.
+func albumViewETag(a album, parts ...string) string {
+	return fmt.Sprintf(`"%s-%d-%s"`, a.ID, a.Version, strings.Join(parts, "-"))
+}
+
+// ifMatchHeader is the hx-headers value for requests that modify a, so the
+// buttons in the Album card carry the revision they were rendered from.
+func ifMatchHeader(a album) string {
+	b, _ := json.Marshal(map[string]string{"If-Match": albumETag(a)})
+	return string(b)
+}
+
+// expectedVersions returns the versions of album id the client says it is
+// modifying. They come from If-Match, or from the version field UpdateForm
+// submits when the header is absent. anyVersion is set for "If-Match: *".
+// ok is false if the client sent neither.
+func expectedVersions(c *gin.Context, id string) (versions []int64, anyVersion bool, ok bool) {
+	if header := c.GetHeader("If-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return nil, true, true
+			}
+			// If-Match uses strong comparison, so weak tags never match.
+			if strings.HasPrefix(tag, "W/") || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				continue
+			}
+			tagID, version, found := strings.Cut(tag[1:len(tag)-1], "-")
+			if !found || tagID != id {
+				continue
+			}
+			version, _, _ = strings.Cut(version, "-")
+			v, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				continue
+			}
+			versions = append(versions, v)
+		}
+		return versions, false, true
+	}
+
+	if version := c.Request.FormValue("version"); version != "" {
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, false, true
+		}
+		return []int64{v}, false, true
+	}
+	return nil, false, false
+}
+
+// versionMatches reports whether the current version satisfies what
+// expectedVersions returned.
+func versionMatches(versions []int64, anyVersion bool, current int64) bool {
+	if anyVersion {
+		return true
+	}
+	for _, v := range versions {
+		if v == current {
+			return true
+		}
+	}
+	return false
+}
+
+func preconditionRequired(c *gin.Context) {
+	c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header or version field is required"})
+}
+
+// conflict answers a write that lost the race to someone else's. htmx
+// requests get a card comparing the current album with the submitted one
+// (mine is nil for deletes); other clients get the current album as JSON.
+func conflict(c *gin.Context, current album, mine *album) {
+	c.Header("ETag", albumETag(current))
+	if c.GetHeader("HX-Request") != "true" {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "album has been modified", "current": current})
+		return
+	}
+
+	c.Header("HX-Retarget", "closest .album-card")
+	c.Header("HX-Reswap", "outerHTML")
+	if mine == nil {
+		render(c, http.StatusPreconditionFailed, DeleteConflict(current))
+		return
+	}
+	render(c, http.StatusPreconditionFailed, UpdateConflict(current, *mine))
+}
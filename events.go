@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// albumEvent says an album was created, updated or deleted. Subscribers
+// fetch the album themselves, so they always show its latest state.
+type albumEvent struct {
+	Kind    string `json:"kind"`
+	AlbumID string `json:"album_id"`
+}
+
+const (
+	// subscriberBuffer is how many events a subscriber may fall behind
+	// before it starts missing them.
+	subscriberBuffer = 64
+
+	// streamHeartbeat keeps idle event streams from being closed by
+	// proxies.
+	streamHeartbeat = 25 * time.Second
+)
+
+// eventHub fans album events out to the open event streams of this
+// process. listenForChanges feeds it with the changes of every instance.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan albumEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan albumEvent]struct{}{}}
+}
+
+var albumEvents = newEventHub()
+
+// serverClosing is closed when the server starts shutting down, to end
+// event streams and long polls.
+var serverClosing = make(chan struct{})
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription.
+func (h *eventHub) Subscribe() (<-chan albumEvent, func()) {
+	ch := make(chan albumEvent, subscriberBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends an event to every subscriber without waiting. One that
+// has fallen too far behind misses it rather than holding up the rest.
+func (h *eventHub) Publish(e albumEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("Event stream fell behind, dropped %s of album %s", e.Kind, e.AlbumID)
+		}
+	}
+}
+
+// streamEvents is the server-sent event stream behind the live album grid.
+// New albums arrive as "album-created" with the card to append; changes
+// to an album arrive as "album-<id>", carrying the card to replace it
+// with, or nothing when it should go. Cards are rendered for this client,
+// in its time zone and at its prices.
+func streamEvents(c *gin.Context) {
+	filter := parseBrowseFilter(c)
+	events, unsubscribe := albumEvents.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	// Tells nginx-style proxies not to buffer the stream.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-serverClosing:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		case e := <-events:
+			name, data, err := renderAlbumEvent(ctx, e, filter)
+			if err != nil {
+				log.Printf("Failed to render %s of album %s: %v", e.Kind, e.AlbumID, err)
+				continue
+			}
+			if name == "" {
+				continue
+			}
+			if err = writeServerSentEvent(c.Writer, name, data); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// renderAlbumEvent turns an event into the name and HTML a grid showing
+// filter expects. An album that has gone by the time it is fetched, or no
+// longer matches the filter, is sent as deleted whatever the event said,
+// so its card leaves the grid. New albums outside the filter are not sent
+// at all, which the empty name says.
+func renderAlbumEvent(ctx context.Context, e albumEvent, filter browseFilter) (string, string, error) {
+	name := "album-" + e.AlbumID
+	if e.Kind == "deleted" {
+		return name, "", nil
+	}
+	a, err := fetchAlbum(e.AlbumID)
+	if err == sql.ErrNoRows {
+		return name, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if len(filter.values()) > 0 {
+		ok, err := filter.matches(db, e.AlbumID)
+		if err != nil {
+			return "", "", err
+		}
+		if !ok && e.Kind == "created" {
+			return "", "", nil
+		}
+		if !ok {
+			return name, "", nil
+		}
+	}
+	if e.Kind == "created" {
+		name = "album-created"
+	}
+	// Promotions change over the life of a stream, so each card looks
+	// them up afresh.
+	var buf bytes.Buffer
+	if err = Album(a).Render(withShelfPromotions(ctx), &buf); err != nil {
+		return "", "", err
+	}
+	return name, buf.String(), nil
+}
+
+// writeServerSentEvent writes one event, splitting data across as many
+// data lines as it has lines.
+func writeServerSentEvent(w http.ResponseWriter, name, data string) error {
+	var b strings.Builder
+	b.WriteString("event: " + name + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := fmt.Fprint(w, b.String())
+	return err
+}
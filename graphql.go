@@ -0,0 +1,752 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxGraphQLRequest caps the body of a GraphQL request.
+	maxGraphQLRequest = 64 << 10
+
+	// maxQueryComplexity is the most a query may cost, as counted by
+	// queryComplexity.
+	maxQueryComplexity = 2500
+)
+
+var errGraphQLTooLarge = fmt.Errorf("a GraphQL request must be at most %d KB", maxGraphQLRequest>>10)
+
+// graphqlListSizes is what queryComplexity assumes a list field without a
+// first argument returns.
+var graphqlListSizes = map[string]int{
+	"albums":  defaultAlbumPage,
+	"tracks":  20,
+	"aliases": 5,
+}
+
+// batchLoader collects the keys resolvers ask for and fetches them all
+// with one query when the first of them is needed. Queries are resolved a
+// level at a time, so every album in a page asks for its artist before
+// any artist is read. A loader lives for one request, which resolves its
+// fields one at a time, so it needs no locking.
+type batchLoader[K comparable, V any] struct {
+	fetch   func(ctx context.Context, keys []K) (map[K]V, error)
+	pending []K
+	results map[K]V
+	errs    map[K]error
+}
+
+func newBatchLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{fetch: fetch, results: map[K]V{}, errs: map[K]error{}}
+}
+
+// Load asks for key and returns a thunk that gives its value, which is
+// the zero value if there is none.
+func (l *batchLoader[K, V]) Load(ctx context.Context, key K) func() (V, error) {
+	_, done := l.results[key]
+	if _, failed := l.errs[key]; !done && !failed && !slices.Contains(l.pending, key) {
+		l.pending = append(l.pending, key)
+	}
+	return func() (V, error) {
+		if slices.Contains(l.pending, key) {
+			keys := l.pending
+			l.pending = nil
+			found, err := l.fetch(ctx, keys)
+			for _, k := range keys {
+				if err != nil {
+					l.errs[k] = err
+				} else {
+					l.results[k] = found[k]
+				}
+			}
+		}
+		return l.results[key], l.errs[key]
+	}
+}
+
+// thunk adapts a loaded value for graphql-go, which resolves fields that
+// return a func() (interface{}, error) only once the level is complete.
+func thunk[V any](load func() (V, error), convert func(V) interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		v, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return convert(v), nil
+	}
+}
+
+func same[V any](v V) interface{} { return v }
+
+// graphqlRequest is what resolvers need of the request they answer.
+type graphqlRequest struct {
+	c            *gin.Context
+	artists      *batchLoader[string, *artist]
+	aliases      *batchLoader[string, []artistAlias]
+	artistAlbums *batchLoader[string, []album]
+	tracks       *batchLoader[string, []track]
+}
+
+type graphqlRequestKey struct{}
+
+func newGraphQLRequest(c *gin.Context) *graphqlRequest {
+	return &graphqlRequest{
+		c:            c,
+		artists:      newBatchLoader(loadArtists),
+		aliases:      newBatchLoader(loadArtistAliases),
+		artistAlbums: newBatchLoader(loadArtistAlbums),
+		tracks:       newBatchLoader(loadAlbumTracks),
+	}
+}
+
+func requestFor(p graphql.ResolveParams) *graphqlRequest {
+	return p.Context.Value(graphqlRequestKey{}).(*graphqlRequest)
+}
+
+func loadArtists(ctx context.Context, ids []string) (map[string]*artist, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, bio FROM artists WHERE id = ANY($1::int[])", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[string]*artist{}
+	for rows.Next() {
+		var a artist
+		if err := rows.Scan(&a.ID, &a.Name, &a.Bio); err != nil {
+			return nil, err
+		}
+		found[a.ID] = &a
+	}
+	return found, rows.Err()
+}
+
+func loadArtistAliases(ctx context.Context, ids []string) (map[string][]artistAlias, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT artist_id, id, alias FROM artist_aliases
+        WHERE artist_id = ANY($1::int[])
+        ORDER BY lower(alias)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[string][]artistAlias{}
+	for rows.Next() {
+		var artistID string
+		var alias artistAlias
+		if err := rows.Scan(&artistID, &alias.ID, &alias.Alias); err != nil {
+			return nil, err
+		}
+		found[artistID] = append(found[artistID], alias)
+	}
+	return found, rows.Err()
+}
+
+func loadArtistAlbums(ctx context.Context, ids []string) (map[string][]album, error) {
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+`
+        FROM albums
+        WHERE artist_id = ANY($1::int[]) AND deleted_at IS NULL
+        ORDER BY lower(title)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	found := map[string][]album{}
+	for _, a := range albums {
+		found[a.ArtistID] = append(found[a.ArtistID], a)
+	}
+	return found, nil
+}
+
+func loadAlbumTracks(ctx context.Context, ids []string) (map[string][]track, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+trackColumns+`
+        FROM tracks
+        WHERE album_id = ANY($1::int[])
+        ORDER BY disc_number, position`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[string][]track{}
+	for rows.Next() {
+		t, err := scanTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		found[t.AlbumID] = append(found[t.AlbumID], t)
+	}
+	return found, rows.Err()
+}
+
+// graphqlError is an error clients can tell apart by the code in its
+// extensions.
+type graphqlError struct {
+	error
+	extensions map[string]interface{}
+}
+
+func (e graphqlError) Extensions() map[string]interface{} { return e.extensions }
+
+func badUserInput(err error) error {
+	return graphqlError{err, map[string]interface{}{"code": "BAD_USER_INPUT"}}
+}
+
+// graphqlWriteError is albumWriteError for the mutations.
+func graphqlWriteError(err error) error {
+	var conflictErr albumConflict
+	var invalid invalidAlbum
+	switch {
+	case errors.Is(err, errAlbumNotFound):
+		return graphqlError{err, map[string]interface{}{"code": "NOT_FOUND"}}
+	case errors.As(err, &conflictErr):
+		return graphqlError{err, map[string]interface{}{"code": "CONFLICT", "currentVersion": conflictErr.current.Version}}
+	case errors.As(err, &invalid):
+		return badUserInput(err)
+	}
+	if msg, ok := releaseConflict(err); ok {
+		return graphqlError{errors.New(msg), map[string]interface{}{"code": "CONFLICT"}}
+	}
+	return err
+}
+
+// albumInputNames maps the form names album writes are bound by to the
+// fields of AlbumInput, where they differ.
+var albumInputNames = map[string]string{
+	"catalog_number": "catalogNumber",
+	"remove_cover":   "removeCover",
+}
+
+// albumInput reads an AlbumInput as if it were a form, so mutations are
+// validated exactly as postAlbums and updateAlbumByID are. A field left
+// out or null counts as not sent.
+func albumInput(input map[string]interface{}) albumValues {
+	return func(name string) (string, bool) {
+		field := name
+		if f, ok := albumInputNames[name]; ok {
+			field = f
+		}
+		switch v := input[field].(type) {
+		case string:
+			return v, true
+		case int:
+			return strconv.Itoa(v), true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			if v {
+				return "true", true
+			}
+			return "", true
+		case []interface{}:
+			return strings.Join(stringList(v), ","), true
+		default:
+			return "", false
+		}
+	}
+}
+
+func stringList(v interface{}) []string {
+	items, _ := v.([]interface{})
+	var out []string
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// albumField resolves a field from the album being resolved.
+func albumField(f func(a album) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return f(p.Source.(album)), nil
+	}
+}
+
+// optional gives null for the zero values the album row uses for
+// "not known".
+func optional[T comparable](v T) interface{} {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
+}
+
+var graphqlSchema = func() graphql.Schema {
+	nonNullString := graphql.NewNonNull(graphql.String)
+	stringsType := graphql.NewList(nonNullString)
+
+	trackType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Track",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"disc":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"position": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"title":    &graphql.Field{Type: nonNullString},
+			"duration": &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Length in seconds."},
+			"isrc":     &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return optional(p.Source.(track).ISRC), nil }},
+		},
+	})
+
+	artistType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Artist",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"name": &graphql.Field{Type: nonNullString},
+			"bio":  &graphql.Field{Type: nonNullString},
+			"aliases": &graphql.Field{
+				Type: graphql.NewNonNull(stringsType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					a := p.Source.(*artist)
+					return thunk(requestFor(p).aliases.Load(p.Context, a.ID), func(aliases []artistAlias) interface{} {
+						names := []string{}
+						for _, alias := range aliases {
+							names = append(names, alias.Alias)
+						}
+						return names
+					}), nil
+				},
+			},
+		},
+	})
+
+	albumType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Album",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"title": &graphql.Field{Type: nonNullString},
+			"artistName": &graphql.Field{
+				Type:        nonNullString,
+				Description: "The artist's name as credited on the album.",
+				Resolve:     albumField(func(a album) interface{} { return a.Artist }),
+			},
+			"artist": &graphql.Field{
+				Type: artistType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					a := p.Source.(album)
+					if a.ArtistID == "" {
+						return nil, nil
+					}
+					return thunk(requestFor(p).artists.Load(p.Context, a.ArtistID), func(art *artist) interface{} {
+						if art == nil {
+							return nil
+						}
+						return art
+					}), nil
+				},
+			},
+			"price": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"effectivePrice": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Float),
+				Description: "The price after shelf promotions.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					price, _ := effectivePrice(p.Context, p.Source.(album))
+					return price, nil
+				},
+			},
+			"version":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: albumField(func(a album) interface{} { return a.Version })},
+			"year":          &graphql.Field{Type: graphql.Int, Resolve: albumField(func(a album) interface{} { return optional(a.Year) })},
+			"label":         &graphql.Field{Type: graphql.String, Resolve: albumField(func(a album) interface{} { return optional(a.Label) })},
+			"format":        &graphql.Field{Type: graphql.String, Resolve: albumField(func(a album) interface{} { return optional(a.Format) })},
+			"catalogNumber": &graphql.Field{Type: graphql.String, Resolve: albumField(func(a album) interface{} { return optional(a.CatalogNumber) })},
+			"barcode":       &graphql.Field{Type: graphql.String, Resolve: albumField(func(a album) interface{} { return optional(a.Barcode) })},
+			"coverUrl": &graphql.Field{
+				Type: graphql.String,
+				Args: graphql.FieldConfigArgument{
+					"size": &graphql.ArgumentConfig{Type: graphql.NewEnum(graphql.EnumConfig{
+						Name:   "CoverSize",
+						Values: graphql.EnumValueConfigMap{"THUMB": {Value: "thumb"}, "FULL": {Value: "full"}},
+					}), DefaultValue: "full"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					a := p.Source.(album)
+					if a.Cover == "" {
+						return nil, nil
+					}
+					return coverURL(a.Cover, p.Args["size"].(string)), nil
+				},
+			},
+			"stock":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"lowStock":  &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: albumField(func(a album) interface{} { return a.LowStock() })},
+			"genres":    &graphql.Field{Type: graphql.NewNonNull(stringsType), Resolve: albumField(func(a album) interface{} { return a.Genres })},
+			"tags":      &graphql.Field{Type: graphql.NewNonNull(stringsType), Resolve: albumField(func(a album) interface{} { return a.Tags })},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: albumField(func(a album) interface{} { return a.CreatedAt })},
+			"updatedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: albumField(func(a album) interface{} { return a.UpdatedAt })},
+			"tracks": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(trackType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					a := p.Source.(album)
+					return thunk(requestFor(p).tracks.Load(p.Context, a.ID), same[[]track]), nil
+				},
+			},
+		},
+	})
+
+	// Artists and albums refer to each other, so one side is added once
+	// both exist.
+	artistType.AddFieldConfig("albums", &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(albumType))),
+		Description: "The artist's albums, by title.",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			a := p.Source.(*artist)
+			return thunk(requestFor(p).artistAlbums.Load(p.Context, a.ID), same[[]album]), nil
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"endCursor": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return optional(p.Source.(albumPage).next), nil
+				},
+			},
+			"hasNextPage": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(albumPage).next != "", nil },
+			},
+		},
+	})
+
+	albumConnectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AlbumConnection",
+		Fields: graphql.Fields{
+			"nodes": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(albumType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(albumPage).albums, nil },
+			},
+			"totalCount": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(albumPage).total, nil },
+			},
+			"pageInfo": &graphql.Field{
+				Type:    graphql.NewNonNull(pageInfoType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source, nil },
+			},
+		},
+	})
+
+	// AlbumFilter is the facet selection of the browse page; values within
+	// a field are alternatives, and fields all have to match.
+	albumFilterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AlbumFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"genres":  &graphql.InputObjectFieldConfig{Type: stringsType},
+			"tags":    &graphql.InputObjectFieldConfig{Type: stringsType},
+			"artists": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.ID)), Description: "Artist ids."},
+			"prices":  &graphql.InputObjectFieldConfig{Type: stringsType, Description: "Price bands: under-10, 10-20, 20-50 or 50-up."},
+			"formats": &graphql.InputObjectFieldConfig{Type: stringsType},
+			"decades": &graphql.InputObjectFieldConfig{Type: stringsType, Description: "Decades such as 1970."},
+		},
+	})
+
+	// Title, artist and price are nullable so that leaving them out gets
+	// the same error as an incomplete form.
+	albumInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AlbumInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"artist":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"price":         &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"year":          &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"label":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"format":        &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"catalogNumber": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"barcode":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"genres":        &graphql.InputObjectFieldConfig{Type: stringsType},
+			"tags":          &graphql.InputObjectFieldConfig{Type: stringsType},
+			"removeCover":   &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"albums": &graphql.Field{
+				Type:        graphql.NewNonNull(albumConnectionType),
+				Description: "Live albums matching filter, in the order they were added.",
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: albumFilterType},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultAlbumPage},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolveAlbums,
+			},
+			"album": &graphql.Field{
+				Type: albumType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if _, err := strconv.Atoi(id); err != nil {
+						return nil, nil
+					}
+					a, err := fetchAlbum(id)
+					if errors.Is(err, sql.ErrNoRows) {
+						return nil, nil
+					}
+					return a, err
+				},
+			},
+			"artist": &graphql.Field{
+				Type: artistType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if _, err := strconv.Atoi(id); err != nil {
+						return nil, nil
+					}
+					return thunk(requestFor(p).artists.Load(p.Context, id), func(art *artist) interface{} {
+						if art == nil {
+							return nil
+						}
+						return art
+					}), nil
+				},
+			},
+		},
+	})
+
+	versionArg := &graphql.ArgumentConfig{
+		Type:        graphql.NewNonNull(graphql.Int),
+		Description: "The version the change was based on; a changed album is a CONFLICT.",
+	}
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createAlbum": &graphql.Field{
+				Type: graphql.NewNonNull(albumType),
+				Args: graphql.FieldConfigArgument{"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(albumInputType)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					get := albumInput(p.Args["input"].(map[string]interface{}))
+					var newAlbum album
+					if err := bindAlbumFields(get, &newAlbum); err != nil {
+						return nil, badUserInput(err)
+					}
+					genres, tags, err := bindAlbumTerms(get)
+					if err != nil {
+						return nil, badUserInput(err)
+					}
+					if err = bindRelease(get, &newAlbum.release); err != nil {
+						return nil, badUserInput(err)
+					}
+					created, err := createAlbum(p.Context, requestAuditor(requestFor(p).c), newAlbum, genres, tags, nil)
+					if err != nil {
+						return nil, graphqlWriteError(err)
+					}
+					return created, nil
+				},
+			},
+			"updateAlbum": &graphql.Field{
+				Type: graphql.NewNonNull(albumType),
+				Args: graphql.FieldConfigArgument{
+					"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"version": versionArg,
+					"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(albumInputType)},
+				},
+				Description: "Replaces an album's title, artist and price, and whichever other fields input has.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if _, err := strconv.Atoi(id); err != nil {
+						return nil, graphqlWriteError(errAlbumNotFound)
+					}
+					get := albumInput(p.Args["input"].(map[string]interface{}))
+					a := album{ID: id}
+					if err := bindAlbumFields(get, &a); err != nil {
+						return nil, badUserInput(err)
+					}
+					genres, tags, err := bindAlbumTerms(get)
+					if err != nil {
+						return nil, badUserInput(err)
+					}
+					versions := []int64{int64(p.Args["version"].(int))}
+					updated, err := updateAlbum(p.Context, requestAuditor(requestFor(p).c), a, versions, false, get, genres, tags, nil)
+					if err != nil {
+						return nil, graphqlWriteError(err)
+					}
+					return updated, nil
+				},
+			},
+			"deleteAlbum": &graphql.Field{
+				Type:        graphql.NewNonNull(albumType),
+				Description: "Moves an album to the trash, returning it as it was deleted.",
+				Args: graphql.FieldConfigArgument{
+					"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"version": versionArg,
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id := p.Args["id"].(string)
+					if _, err := strconv.Atoi(id); err != nil {
+						return nil, graphqlWriteError(errAlbumNotFound)
+					}
+					versions := []int64{int64(p.Args["version"].(int))}
+					deleted, err := deleteAlbum(p.Context, requestAuditor(requestFor(p).c), id, versions, false)
+					if err != nil {
+						return nil, graphqlWriteError(err)
+					}
+					return deleted, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(fmt.Sprintf("graphql schema: %v", err))
+	}
+	return schema
+}()
+
+func resolveAlbums(p graphql.ResolveParams) (interface{}, error) {
+	first, _ := p.Args["first"].(int)
+	if first < 1 || first > maxAlbumPage {
+		return nil, badUserInput(fmt.Errorf("first must be between 1 and %d", maxAlbumPage))
+	}
+	in, _ := p.Args["filter"].(map[string]interface{})
+	filter := browseFilter{
+		Genres:  stringList(in["genres"]),
+		Tags:    stringList(in["tags"]),
+		Artists: stringList(in["artists"]),
+		Prices:  stringList(in["prices"]),
+		Formats: stringList(in["formats"]),
+		Decades: stringList(in["decades"]),
+	}
+	after, _ := p.Args["after"].(string)
+	page, err := pageAlbums(p.Context, filter, after, first)
+	if errors.Is(err, errInvalidCursor) {
+		return nil, badUserInput(err)
+	}
+	return page, err
+}
+
+// queryComplexity estimates what running a query would cost: one for
+// each field, with the fields under a list counted once for each item it
+// may return. That is first where it is given, and graphqlListSizes
+// otherwise. It expects a document that has passed validation, so
+// fragments are known and not cyclic.
+func queryComplexity(doc *ast.Document, operationName string, variables map[string]interface{}) int {
+	fragments := map[string]*ast.FragmentDefinition{}
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			if op == nil && (operationName == "" || def.Name != nil && def.Name.Value == operationName) {
+				op = def
+			}
+		}
+	}
+	if op == nil {
+		return 0
+	}
+
+	var cost func(set *ast.SelectionSet) int
+	cost = func(set *ast.SelectionSet) int {
+		if set == nil {
+			return 0
+		}
+		total := 0
+		for _, sel := range set.Selections {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				total += 1 + listSize(sel, variables)*cost(sel.SelectionSet)
+			case *ast.InlineFragment:
+				total += cost(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				if f := fragments[sel.Name.Value]; f != nil {
+					total += cost(f.SelectionSet)
+				}
+			}
+		}
+		return total
+	}
+	return cost(op.SelectionSet)
+}
+
+// listSize is how many items queryComplexity assumes field returns.
+func listSize(field *ast.Field, variables map[string]interface{}) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		var n int
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			n, _ = strconv.Atoi(v.Value)
+		case *ast.Variable:
+			switch x := variables[v.Name.Value].(type) {
+			case float64:
+				n = int(x)
+			case int:
+				n = x
+			default:
+				n = defaultAlbumPage
+			}
+		}
+		// Out of range values are refused by the resolver anyway.
+		return max(1, min(n, maxAlbumPage))
+	}
+	if n, ok := graphqlListSizes[field.Name.Value]; ok {
+		return n
+	}
+	return 1
+}
+
+type graphqlParams struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// postGraphQL answers GraphQL queries and mutations over the catalog.
+// Mutations go through the same code, checks and auditing as the form
+// handlers. A query that does not parse, is invalid or costs more than
+// maxQueryComplexity is refused with 400 before anything runs; errors in
+// individual fields come back beside the data with 200, as GraphQL does.
+func postGraphQL(c *gin.Context) {
+	var params graphqlParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gqlerrors.FormatErrors(err)})
+		return
+	}
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(params.Query), Name: "GraphQL request"})})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": gqlerrors.FormatErrors(err)})
+		return
+	}
+	if res := graphql.ValidateDocument(&graphqlSchema, doc, nil); !res.IsValid {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": res.Errors})
+		return
+	}
+	if cost := queryComplexity(doc, params.OperationName, params.Variables); cost > maxQueryComplexity {
+		err := graphqlError{
+			fmt.Errorf("query costs %d, more than the limit of %d", cost, maxQueryComplexity),
+			map[string]interface{}{"code": "QUERY_TOO_COMPLEX", "cost": cost, "limit": maxQueryComplexity},
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gqlerrors.FormattedError{{Message: err.Error(), Extensions: err.extensions}}})
+		return
+	}
+
+	ctx := context.WithValue(c.Request.Context(), graphqlRequestKey{}, newGraphQLRequest(c))
+	c.JSON(http.StatusOK, graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphqlSchema,
+		AST:           doc,
+		OperationName: params.OperationName,
+		Args:          params.Variables,
+		Context:       ctx,
+	}))
+}
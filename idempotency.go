@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// idempotencyKeyField is the form field that carries the key for
+	// forms, which cannot set headers of their own.
+	idempotencyKeyField = "idempotency_key"
+
+	maxIdempotencyKey = 255
+
+	// idempotencyKeyLifetime is how long a key's response is kept for
+	// replays.
+	idempotencyKeyLifetime = 24 * time.Hour
+
+	// idempotencyWait is how long a repeat waits for the original request
+	// to finish before giving up with 409. idempotencyAbandoned is when a
+	// key whose request never finished is taken to be free again.
+	idempotencyWait      = 10 * time.Second
+	idempotencyPoll      = 100 * time.Millisecond
+	idempotencyAbandoned = time.Minute
+)
+
+// idempotent makes a POST safe to retry. A request with an
+// Idempotency-Key header, or an idempotency_key form field, runs once per
+// key and caller; repeats get the first response again, marked with
+// Idempotent-Replayed, and a repeat that arrives while the first is still
+// running waits for it. Reusing a key for a different request is a 422.
+// Only successful responses are kept: a request that failed changed
+// nothing, so it can be corrected and sent again with the same key. It
+// goes after limitBody, since it reads the body.
+//
+// Customers are all anonymous, so keys are kept per session as well as per
+// actor, and one customer cannot be replayed another's cart or order.
+// Cookies are not replayed, as they would hand the session on.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" && isFormRequest(c) {
+			key = c.PostForm(idempotencyKeyField)
+		}
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		fingerprint, err := requestFingerprint(c)
+		if err != nil {
+			// The handler reads the same body, and reports the problem
+			// better than we can.
+			c.Next()
+			return
+		}
+
+		owner := idempotencyOwner{actor: auditActor(c), session: sessionID(c, false)}
+		for attempt := 0; ; attempt++ {
+			claimed, err := claimIdempotencyKey(owner, key, fingerprint)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if claimed {
+				break
+			}
+			// The key goes free again if the request holding it fails, and
+			// then this one can have it.
+			if replayIdempotentResponse(c, owner, key, fingerprint) {
+				return
+			}
+			if attempt == 2 {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "requests with this Idempotency-Key keep failing"})
+				return
+			}
+		}
+
+		rec := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = rec
+		saved := false
+		defer func() {
+			if !saved {
+				if _, err := db.Exec("DELETE FROM idempotency_keys WHERE actor = $1 AND session_id = $2 AND key = $3", owner.actor, owner.session, key); err != nil {
+					log.Printf("Failed to release idempotency key %q: %v", key, err)
+				}
+			}
+		}()
+		c.Next()
+
+		status := rec.Status()
+		if status < 200 || status >= 300 {
+			return
+		}
+		header := rec.Header().Clone()
+		header.Del("X-Request-ID")
+		header.Del("Set-Cookie")
+		headerJSON, err := json.Marshal(header)
+		if err != nil {
+			log.Printf("Failed to save the response for idempotency key %q: %v", key, err)
+			return
+		}
+		_, err = db.Exec(`
+            UPDATE idempotency_keys SET status = $1, header = $2, body = $3
+            WHERE actor = $4 AND session_id = $5 AND key = $6`, status, string(headerJSON), rec.body.Bytes(), owner.actor, owner.session, key)
+		if err != nil {
+			log.Printf("Failed to save the response for idempotency key %q: %v", key, err)
+			return
+		}
+		saved = true
+	}
+}
+
+// idempotencyOwner is whose keys a request uses.
+type idempotencyOwner struct {
+	actor   string
+	session string
+}
+
+func isFormRequest(c *gin.Context) bool {
+	ct := c.ContentType()
+	return ct == gin.MIMEPOSTForm || ct == gin.MIMEMultipartPOSTForm
+}
+
+// requestFingerprint identifies what a request asks for, so a key reused
+// for something else is caught. Forms are fingerprinted by their fields
+// and files rather than their bytes, because a browser sending the same
+// multipart form twice picks a new boundary each time.
+func requestFingerprint(c *gin.Context) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, c.Request.Method+" "+c.Request.URL.Path+"\n")
+	if !isFormRequest(c) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return "", err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	// c.PostForm has parsed the form already.
+	if c.Request.PostForm == nil {
+		return "", errors.New("form could not be parsed")
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Request.PostForm)) {
+		for _, v := range c.Request.PostForm[name] {
+			io.WriteString(h, "field "+name+"="+v+"\n")
+		}
+	}
+	if form := c.Request.MultipartForm; form != nil {
+		for _, name := range slices.Sorted(maps.Keys(form.File)) {
+			for _, fh := range form.File[name] {
+				f, err := fh.Open()
+				if err != nil {
+					return "", err
+				}
+				sum := sha256.New()
+				_, err = io.Copy(sum, f)
+				f.Close()
+				if err != nil {
+					return "", err
+				}
+				io.WriteString(h, "file "+name+"="+fh.Filename+" "+hex.EncodeToString(sum.Sum(nil))+"\n")
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// claimIdempotencyKey records that a request with key has started. It
+// reports false when the key is already taken, by a finished request or
+// one still running; expired keys and abandoned ones are taken over.
+func claimIdempotencyKey(owner idempotencyOwner, key, fingerprint string) (bool, error) {
+	var claimed bool
+	err := db.QueryRow(`
+        INSERT INTO idempotency_keys (actor, session_id, key, fingerprint, expires_at)
+        VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+        ON CONFLICT (actor, session_id, key) DO UPDATE
+        SET fingerprint = EXCLUDED.fingerprint, status = NULL, header = NULL, body = NULL,
+            created_at = now(), expires_at = EXCLUDED.expires_at
+        WHERE idempotency_keys.expires_at < now()
+           OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at < now() - make_interval(secs => $6))
+        RETURNING true`, owner.actor, owner.session, key, fingerprint, idempotencyKeyLifetime.Seconds(), idempotencyAbandoned.Seconds()).Scan(&claimed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return claimed, err
+}
+
+// replayIdempotentResponse answers a repeated key with the response the
+// first request got, waiting for it if need be. It reports false, having
+// written nothing, if the first request failed and released the key.
+func replayIdempotentResponse(c *gin.Context, owner idempotencyOwner, key, fingerprint string) bool {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), idempotencyWait)
+	defer cancel()
+	for {
+		var saved string
+		var status *int
+		var header []byte
+		var body []byte
+		err := db.QueryRowContext(ctx, `
+            SELECT fingerprint, status, COALESCE(header, '{}'), COALESCE(body, '') FROM idempotency_keys
+            WHERE actor = $1 AND session_id = $2 AND key = $3`, owner.actor, owner.session, key).Scan(&saved, &status, &header, &body)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		if err != nil && ctx.Err() == nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return true
+		}
+		if err == nil && saved != fingerprint {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			return true
+		}
+		if err == nil && status != nil {
+			var h http.Header
+			if err := json.Unmarshal(header, &h); err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return true
+			}
+			for name, values := range h {
+				if !strings.EqualFold(name, "Cache-Control") {
+					c.Writer.Header()[name] = values
+				}
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Status(*status)
+			c.Writer.Write(body)
+			c.Abort()
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still in progress"})
+			return true
+		case <-time.After(idempotencyPoll):
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response body as it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// expireIdempotencyKeys forgets keys past their lifetime.
+func expireIdempotencyKeys(ctx context.Context, _ struct{}) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()")
+	return err
+}
+
+var expireIdempotencyKeysJob = registerJob("expire_idempotency_keys", jobOptions{Every: purgeInterval}, expireIdempotencyKeys)
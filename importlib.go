@@ -0,0 +1,432 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// audioExtensions are the files import-library looks at.
+var audioExtensions = map[string]bool{
+	".mp3": true, ".flac": true, ".ogg": true, ".oga": true, ".opus": true,
+}
+
+// libraryAlbum is an album assembled from the audio files that share its
+// album tag.
+type libraryAlbum struct {
+	Title  string
+	Artist string
+	Year   int
+	Label  string
+	Genres []string
+	Tracks []track
+}
+
+type skippedFile struct {
+	Path   string
+	Reason string
+}
+
+type importResult struct {
+	Action string // create, update or unchanged
+	Album  album
+	Tracks []track
+	Notes  []string
+}
+
+// importLibrary implements the import-library command. It scans a music
+// directory and creates or updates an album for every album it finds. The
+// whole import runs in one transaction, which is rolled back unless -apply
+// is given, so the preview reports exactly what applying would do. With
+// -queue, the import is left to the server's job workers instead.
+func importLibrary(args []string) error {
+	flags := flag.NewFlagSet("import-library", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "write the changes; without it the import is only previewed")
+	queue := flags.Bool("queue", false, "queue the import for the server to apply; DIR must be readable by the server")
+	price := flags.Float64("price", 0, "price for the albums the import creates")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: web-service-gin import-library [-apply [-queue]] [-price 9.99] DIR")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("import-library needs one directory")
+	}
+	if *price < 0 {
+		return errors.New("price must not be negative")
+	}
+
+	if *queue {
+		// A queued import is not watched, so it has to be previewed first.
+		if !*apply {
+			return errors.New("-queue only queues imports that are applied; preview without it first")
+		}
+		dir, err := filepath.Abs(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		j, err := importLibraryJob.Enqueue(db, libraryImport{Dir: dir, Price: *price}, time.Time{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Queued the import as job %d.\n", j.ID)
+		return nil
+	}
+	return runLibraryImport(context.Background(), os.Stdout, flags.Arg(0), *price, *apply)
+}
+
+// libraryImport is the payload of a queued import.
+type libraryImport struct {
+	Dir   string  `json:"dir"`
+	Price float64 `json:"price"`
+}
+
+// importLibraryJob applies a queued import. Imports are big and touch
+// many of the same artists, so they run one at a time, and are not tried
+// again: the report of a failed one is worth reading first. The report is
+// kept as the job's result.
+var importLibraryJob = registerJob("import_library", jobOptions{MaxAttempts: 1, Timeout: time.Hour},
+	func(ctx context.Context, p libraryImport) error {
+		return runLibraryImport(ctx, jobOutput(ctx), p.Dir, p.Price, true)
+	})
+
+// runLibraryImport imports dir, reporting what it does to out, and
+// commits only if apply is set.
+func runLibraryImport(ctx context.Context, out io.Writer, dir string, price float64, apply bool) error {
+	albums, skipped, err := scanLibrary(dir)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var results []importResult
+	for _, la := range albums {
+		res, err := importAlbum(ctx, tx, la, price)
+		if err != nil {
+			printImportReport(out, results, skipped)
+			fmt.Fprintf(out, "\nFailed at %s - %s: %v\nNothing was written.\n", la.Artist, la.Title, err)
+			return fmt.Errorf("importing %s - %s: %w", la.Artist, la.Title, err)
+		}
+		results = append(results, res)
+	}
+
+	printImportReport(out, results, skipped)
+	if !apply {
+		fmt.Fprintln(out, "\nPreview only; nothing was written. Run again with -apply to import.")
+		return nil
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "\nImport applied.")
+	return nil
+}
+
+// scanLibrary reads the tags of every audio file under dir and groups them
+// into albums. Files with the same album artist and album title belong
+// together; without an album artist, only files in the same directory do,
+// so unrelated albums that share a title stay apart.
+func scanLibrary(dir string) ([]libraryAlbum, []skippedFile, error) {
+	type file struct {
+		path string
+		tags audioTags
+	}
+	groups := map[string][]file{}
+	var keys []string
+	var skipped []skippedFile
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		tags, err := readAudioTags(path)
+		if err != nil {
+			skipped = append(skipped, skippedFile{Path: path, Reason: err.Error()})
+			return nil
+		}
+		album := normalizeArtistName(tags.Album)
+		if album == "" {
+			skipped = append(skipped, skippedFile{Path: path, Reason: "no album tag"})
+			return nil
+		}
+		key := strings.ToLower(normalizeArtistName(tags.AlbumArtist))
+		if key == "" {
+			key = "dir:" + filepath.Dir(path)
+		}
+		key += "\x00" + strings.ToLower(album)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], file{path: path, tags: tags})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var albums []libraryAlbum
+	for _, key := range keys {
+		files := groups[key]
+		slices.SortFunc(files, func(a, b file) int {
+			if c := max(a.tags.Disc, 1) - max(b.tags.Disc, 1); c != 0 {
+				return c
+			}
+			// Untagged track numbers sort after the numbered ones.
+			ta, tb := a.tags.Track, b.tags.Track
+			if (ta == 0) != (tb == 0) {
+				if ta == 0 {
+					return 1
+				}
+				return -1
+			}
+			if ta != tb {
+				return ta - tb
+			}
+			return strings.Compare(a.path, b.path)
+		})
+
+		var la libraryAlbum
+		var titles, artists, years, labels []string
+		seenGenre := map[string]bool{}
+		positions := map[int]int{}
+		for _, f := range files {
+			t := f.tags
+			titles = append(titles, normalizeArtistName(t.Album))
+			artists = append(artists, normalizeArtistName(cmp.Or(t.AlbumArtist, t.Artist)))
+			if t.Year != 0 {
+				years = append(years, fmt.Sprint(t.Year))
+			}
+			if t.Label != "" {
+				labels = append(labels, normalizeArtistName(t.Label))
+			}
+			for _, g := range t.Genres {
+				if g = normalizeArtistName(g); g != "" && len(g) <= maxTermLength && !seenGenre[strings.ToLower(g)] {
+					seenGenre[strings.ToLower(g)] = true
+					la.Genres = append(la.Genres, g)
+				}
+			}
+
+			// Positions are renumbered from 1 on each disc, since the track
+			// list does not allow gaps.
+			disc := max(t.Disc, 1)
+			positions[disc]++
+			isrc, err := normalizeISRC(t.ISRC)
+			if err != nil {
+				isrc = ""
+			}
+			la.Tracks = append(la.Tracks, track{
+				Disc:     disc,
+				Position: positions[disc],
+				Title:    cmp.Or(strings.TrimSpace(t.Title), strings.TrimSuffix(filepath.Base(f.path), filepath.Ext(f.path))),
+				Duration: t.Duration,
+				ISRC:     isrc,
+			})
+		}
+		la.Title = mostCommon(titles)
+		la.Artist = mostCommon(artists)
+		switch {
+		case la.Artist == "":
+			la.Artist = "Unknown Artist"
+		case strings.HasPrefix(key, "dir:") && !allSame(artists):
+			// A directory of tracks by several artists with no album
+			// artist is a compilation.
+			la.Artist = "Various Artists"
+		}
+		la.Year, _ = strconv.Atoi(mostCommon(years))
+		la.Label = mostCommon(labels)
+		albums = append(albums, la)
+	}
+	return albums, skipped, nil
+}
+
+// mostCommon picks the value that occurs most often, ignoring case, and
+// the first one seen on a tie.
+func mostCommon(values []string) string {
+	counts := map[string]int{}
+	best := ""
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		k := strings.ToLower(v)
+		counts[k]++
+		if best == "" || counts[k] > counts[strings.ToLower(best)] {
+			best = v
+		}
+	}
+	return best
+}
+
+func allSame(values []string) bool {
+	for _, v := range values {
+		if !strings.EqualFold(v, values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// importAlbum creates la, or brings the matching live album by the same
+// artist up to date: its track list is replaced and empty release fields
+// and missing genres are filled in. Prices and anything typed in by hand
+// are left alone. Albums are written through the same store as the web
+// API, with the system as the actor.
+func importAlbum(ctx context.Context, tx *sql.Tx, la libraryAlbum, price float64) (importResult, error) {
+	var res importResult
+	if la.Year != 0 && (la.Year < firstReleaseYear || la.Year > time.Now().Year()+1) {
+		la.Year = 0
+	}
+
+	art, err := resolveArtist(tx, la.Artist)
+	if err != nil {
+		return res, err
+	}
+	current, err := scanAlbum(tx.QueryRow(`
+        SELECT `+albumColumns+` FROM albums
+        WHERE artist_id = $1 AND lower(title) = lower($2) AND deleted_at IS NULL
+        ORDER BY id LIMIT 1
+        FOR UPDATE`, art.ID, la.Title))
+	if err == sql.ErrNoRows {
+		return createImportedAlbum(ctx, tx, la, price)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	tracks, err := queryTracks(tx, current.ID)
+	if err != nil {
+		return res, err
+	}
+	year, label := current.Year, current.Label
+	if year == 0 && la.Year != 0 {
+		year = la.Year
+		res.Notes = append(res.Notes, fmt.Sprintf("year %d", year))
+	}
+	if label == "" && la.Label != "" {
+		label = la.Label
+		res.Notes = append(res.Notes, "label "+label)
+	}
+	genres := slices.Clone(current.Genres)
+	for _, g := range la.Genres {
+		if !slices.ContainsFunc(genres, func(c string) bool { return strings.EqualFold(c, g) }) {
+			genres = append(genres, g)
+			res.Notes = append(res.Notes, "genre "+g)
+		}
+	}
+	replaceTracks := !sameTracks(tracks, la.Tracks)
+	if replaceTracks {
+		res.Notes = append(res.Notes, fmt.Sprintf("tracks %d → %d", len(tracks), len(la.Tracks)))
+	}
+	if len(res.Notes) == 0 {
+		res.Action, res.Album, res.Tracks = "unchanged", current, tracks
+		return res, nil
+	}
+
+	if replaceTracks {
+		if _, err = tx.Exec("DELETE FROM tracks WHERE album_id = $1", current.ID); err != nil {
+			return res, err
+		}
+		if err = insertTracks(tx, current.ID, la.Tracks); err != nil {
+			return res, err
+		}
+	}
+	var newGenres []string
+	if len(genres) != len(current.Genres) {
+		newGenres = genres
+	}
+	get := func(name string) (string, bool) {
+		switch name {
+		case "year":
+			return yearValue(year), true
+		case "label":
+			return label, true
+		}
+		return "", false
+	}
+	_, updated, err := saveAlbum(ctx, tx, auditor{actor: "system"}, current, nil, true, get, newGenres, nil, nil)
+	if err != nil {
+		return res, err
+	}
+	res.Action, res.Album, res.Tracks = "update", updated, la.Tracks
+	return res, nil
+}
+
+func createImportedAlbum(ctx context.Context, tx *sql.Tx, la libraryAlbum, price float64) (importResult, error) {
+	res := importResult{Action: "create", Tracks: la.Tracks}
+	a := album{Title: la.Title, Artist: la.Artist, Price: price}
+	a.Year, a.Label = la.Year, normalizeArtistName(la.Label)
+	created, err := insertAlbum(ctx, tx, auditor{actor: "system"}, a, la.Genres, nil, nil)
+	if err != nil {
+		return res, err
+	}
+	if err = insertTracks(tx, created.ID, la.Tracks); err != nil {
+		return res, err
+	}
+	res.Album = created
+	return res, nil
+}
+
+func insertTracks(tx *sql.Tx, albumID string, tracks []track) error {
+	for _, t := range tracks {
+		_, err := tx.Exec(`
+            INSERT INTO tracks (album_id, disc_number, position, title, duration_seconds, isrc)
+            VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`,
+			albumID, t.Disc, t.Position, t.Title, t.Duration, t.ISRC)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameTracks(a, b []track) bool {
+	return slices.EqualFunc(a, b, func(x, y track) bool {
+		return x.Disc == y.Disc && x.Position == y.Position && x.Title == y.Title &&
+			x.Duration == y.Duration && x.ISRC == y.ISRC
+	})
+}
+
+func printImportReport(out io.Writer, results []importResult, skipped []skippedFile) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tALBUM\tTRACKS\tRUNTIME\tCHANGES")
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Action]++
+		// A preview rolls back, so new albums have no ID worth showing.
+		ref := "#" + r.Album.ID + " "
+		if r.Action == "create" {
+			ref = ""
+		}
+		fmt.Fprintf(w, "%s\t%s%s - %s\t%d\t%s\t%s\n",
+			r.Action, ref, r.Album.Artist, r.Album.Title,
+			len(r.Tracks), formatDuration(totalRuntime(r.Tracks)), strings.Join(r.Notes, ", "))
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d to create, %d to update, %d unchanged, %d files skipped\n",
+		counts["create"], counts["update"], counts["unchanged"], len(skipped))
+	for _, s := range skipped {
+		fmt.Fprintf(out, "  skipped %s: %s\n", s.Path, s.Reason)
+	}
+}
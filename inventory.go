@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stockReasons are the kinds of ledger entry that can be recorded by hand.
+// Received stock is added and sold or damaged stock taken away; a
+// correction sets the count to what was found on the shelf. Orders also
+// record "reserved" at checkout and "released" when cancelled.
+var stockReasons = []string{"received", "sold", "damaged", "correction"}
+
+// stockLedgerLimit is how many recent movements the album page shows.
+const stockLedgerLimit = 20
+
+var errInsufficientStock = errors.New("not enough stock")
+
+type stockEntry struct {
+	ID        int64     `json:"id"`
+	AlbumID   string    `json:"album_id"`
+	Delta     int       `json:"delta"`
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	Balance   int       `json:"balance"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const stockEntryColumns = "id, album_id, delta, reason, note, balance, actor, request_id, created_at"
+
+func scanStockEntry(row scanner) (stockEntry, error) {
+	var e stockEntry
+	err := row.Scan(&e.ID, &e.AlbumID, &e.Delta, &e.Reason, &e.Note, &e.Balance, &e.Actor, &e.RequestID, &e.CreatedAt)
+	return e, err
+}
+
+func queryStockLedger(albumID string, limit int) ([]stockEntry, error) {
+	rows, err := db.Query("SELECT "+stockEntryColumns+" FROM stock_ledger WHERE album_id = $1 ORDER BY id DESC LIMIT $2", albumID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []stockEntry
+	for rows.Next() {
+		e, err := scanStockEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// adjustStock changes an album's stock by delta and records why in the
+// ledger, in tx. The update only matches while the result stays at or
+// above zero, and it holds the row lock until tx ends, so concurrent
+// adjustments queue up instead of overselling. Trashed albums keep their
+// stock, so copies can still be returned to them. It returns
+// sql.ErrNoRows if there is no such album and errInsufficientStock if
+// there is not enough on hand. c is nil for changes the server makes on
+// its own. Stock is not part of what editors write, so the album's version
+// stays put and a sale never makes an open edit form conflict.
+func adjustStock(tx *sql.Tx, c *gin.Context, albumID string, delta int, reason, note string) (stockEntry, error) {
+	var balance int
+	err := tx.QueryRow(`
+        UPDATE albums SET stock_on_hand = stock_on_hand + $1
+        WHERE id = $2 AND stock_on_hand + $1 >= 0
+        RETURNING stock_on_hand`, delta, albumID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM albums WHERE id = $1)", albumID).Scan(&exists); err != nil {
+			return stockEntry{}, err
+		}
+		if exists {
+			return stockEntry{}, errInsufficientStock
+		}
+		return stockEntry{}, sql.ErrNoRows
+	}
+	if err != nil {
+		return stockEntry{}, err
+	}
+
+	actor, reqID := "system", ""
+	if c != nil {
+		actor, reqID = auditActor(c), c.GetString("requestID")
+	}
+	return scanStockEntry(tx.QueryRow(`
+        INSERT INTO stock_ledger (album_id, delta, reason, note, balance, actor, request_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING `+stockEntryColumns, albumID, delta, reason, note, balance, actor, reqID))
+}
+
+// postStockAdjustment records a stock movement. quantity is the number of
+// copies received, sold or damaged, or for a correction the number
+// counted.
+func postStockAdjustment(c *gin.Context) {
+	id := c.Param("id")
+	reason := c.PostForm("reason")
+	if !slices.Contains(stockReasons, reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be one of " + strings.Join(stockReasons, ", ")})
+		return
+	}
+	quantity, err := strconv.Atoi(strings.TrimSpace(c.PostForm("quantity")))
+	if err != nil || quantity < 0 || (quantity == 0 && reason != "correction") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quantity"})
+		return
+	}
+	note := strings.TrimSpace(c.PostForm("note"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := lockAlbum(tx, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	delta := quantity
+	switch reason {
+	case "sold", "damaged":
+		delta = -quantity
+	case "correction":
+		delta = quantity - current.Stock
+		if delta == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the count matches the stock on hand"})
+			return
+		}
+	}
+
+	entry, err := adjustStock(tx, c, id, delta, reason, note)
+	if err == errInsufficientStock {
+		c.JSON(http.StatusConflict, gin.H{"error": "that would take the stock below zero"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		stockPanelResponse(c, id)
+		return
+	}
+	c.JSON(http.StatusCreated, entry)
+}
+
+// updateLowStockThreshold sets the stock level at or below which the album
+// is flagged for reordering. Like adjustStock it leaves the version alone.
+func updateLowStockThreshold(c *gin.Context) {
+	id := c.Param("id")
+	threshold, err := strconv.Atoi(strings.TrimSpace(c.PostForm("threshold")))
+	if err != nil || threshold < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid threshold"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := lockAlbum(tx, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	updated, err := scanAlbum(tx.QueryRow(`
+        UPDATE albums SET low_stock_threshold = $1, updated_at = now()
+        WHERE id = $2
+        RETURNING `+albumColumns, threshold, id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = recordAudit(tx, c, "update", &current, &updated); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		stockPanelResponse(c, id)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+func getStockLedger(c *gin.Context) {
+	id := c.Param("id")
+	if c.GetHeader("HX-Request") == "true" {
+		stockPanelResponse(c, id)
+		return
+	}
+	if _, err := fetchAlbum(id); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := queryStockLedger(id, stockLedgerLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func stockPanelResponse(c *gin.Context, id string) {
+	a, err := fetchAlbum(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := queryStockLedger(id, stockLedgerLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	render(c, 200, StockPanel(a, entries))
+}
+
+// inventoryRow is one line of the inventory report.
+type inventoryRow struct {
+	Album        album      `json:"album"`
+	Value        float64    `json:"value"`
+	LastMovement *time.Time `json:"last_movement,omitempty"`
+}
+
+type inventoryReport struct {
+	Rows     []inventoryRow `json:"rows"`
+	Units    int            `json:"units"`
+	Value    float64        `json:"value"`
+	LowCount int            `json:"low_count"`
+	LowOnly  bool           `json:"low_only"`
+}
+
+// getInventory reports stock on hand and its value for every live album,
+// those at or below their threshold first. ?low=1 lists only those.
+func getInventory(c *gin.Context) {
+	report := inventoryReport{LowOnly: c.Query("low") != ""}
+	where := "deleted_at IS NULL"
+	if report.LowOnly {
+		where += " AND stock_on_hand <= low_stock_threshold"
+	}
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE "+where+`
+        ORDER BY stock_on_hand <= low_stock_threshold DESC, lower(artist), lower(title)`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rows, err := db.Query("SELECT album_id, max(created_at) FROM stock_ledger GROUP BY album_id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	lastMovement := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		lastMovement[id] = at
+	}
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, a := range albums {
+		row := inventoryRow{Album: a, Value: float64(a.Stock) * a.Price}
+		if at, ok := lastMovement[a.ID]; ok {
+			row.LastMovement = &at
+		}
+		report.Rows = append(report.Rows, row)
+		report.Units += a.Stock
+		report.Value += row.Value
+		if a.LowStock() {
+			report.LowCount++
+		}
+	}
+
+	if responseVariant(c) == "json" {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	render(c, 200, InventoryPage(report))
+}
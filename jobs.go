@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// jobStatuses are the states a job moves through. A job is queued until a
+// worker claims it, then running. It ends up done, failed once it has used
+// up its attempts, or cancelled by staff. Recurring jobs never end: after
+// each run they are queued again.
+var jobStatuses = []string{"queued", "running", "failed", "done", "cancelled"}
+
+const (
+	// jobPollInterval is how often idle workers look for due jobs.
+	jobPollInterval = time.Second
+
+	defaultJobTimeout  = 5 * time.Minute
+	defaultJobAttempts = 5
+
+	// A failed job is retried after jobBaseDelay, doubling each time up
+	// to jobMaxDelay.
+	jobBaseDelay = 10 * time.Second
+	jobMaxDelay  = time.Hour
+
+	// jobLeaseMargin is how long past its timeout a running job stays
+	// claimed. A job still running after that was left behind by a worker
+	// that died, and is taken up again.
+	jobLeaseMargin = time.Minute
+
+	// jobRetention is how long finished jobs stay listed. Failed jobs are
+	// kept until someone deals with them.
+	jobRetention = 7 * 24 * time.Hour
+
+	// jobListLimit caps the jobs page.
+	jobListLimit = 200
+)
+
+// jobOptions tune a kind of job. Zero values get the defaults.
+type jobOptions struct {
+	// Concurrency is how many jobs of the kind one instance runs at once.
+	Concurrency int
+	// MaxAttempts is how many times a job is tried before it fails.
+	MaxAttempts int
+	// Timeout bounds one attempt.
+	Timeout time.Duration
+	// Every makes the kind recurring. It has a single job, queued again
+	// Every after each run ends, so only one instance runs it at a time.
+	Every time.Duration
+}
+
+// jobKind is a registered kind of job and its handler, which takes the
+// job's payload as JSON.
+type jobKind struct {
+	Name string
+	jobOptions
+	run func(ctx context.Context, payload []byte) error
+}
+
+var jobKinds = map[string]*jobKind{}
+
+// jobType is a kind of job whose payload is a T. Enqueueing through it
+// keeps what is queued in step with what the handler expects.
+type jobType[T any] struct {
+	kind *jobKind
+}
+
+// registerJob adds a kind of job. Kinds are registered when the package
+// is initialised, so every instance knows every kind before it starts
+// claiming jobs.
+func registerJob[T any](name string, opts jobOptions, handle func(context.Context, T) error) jobType[T] {
+	if _, ok := jobKinds[name]; ok {
+		panic("job kind registered twice: " + name)
+	}
+	opts.Concurrency = cmp.Or(opts.Concurrency, 1)
+	opts.MaxAttempts = cmp.Or(opts.MaxAttempts, defaultJobAttempts)
+	opts.Timeout = cmp.Or(opts.Timeout, defaultJobTimeout)
+	k := &jobKind{Name: name, jobOptions: opts}
+	k.run = func(ctx context.Context, payload []byte) error {
+		var v T
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Errorf("bad payload: %w", err)
+		}
+		return handle(ctx, v)
+	}
+	jobKinds[name] = k
+	return jobType[T]{kind: k}
+}
+
+// Enqueue queues a job to run at runAt, or straight away if runAt is
+// zero. Given a transaction, the job is only queued if it commits.
+func (t jobType[T]) Enqueue(q querier, payload T, runAt time.Time) (job, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return job{}, err
+	}
+	var at *time.Time
+	if !runAt.IsZero() {
+		at = &runAt
+	}
+	return scanJob(q.QueryRow(`
+        INSERT INTO jobs (kind, payload, max_attempts, run_at) VALUES ($1, $2, $3, COALESCE($4::timestamptz, now()))
+        RETURNING `+jobColumns, t.kind.Name, string(body), t.kind.MaxAttempts, at))
+}
+
+type job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Recurring   bool            `json:"recurring"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	Result      string          `json:"result,omitempty"`
+	LockedBy    string          `json:"locked_by,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Every is how often a recurring job runs, or 0 for one-off jobs and
+// kinds this build does not know.
+func (j job) Every() time.Duration {
+	if k, ok := jobKinds[j.Kind]; ok && j.Recurring {
+		return k.Every
+	}
+	return 0
+}
+
+const jobColumns = `id, kind, payload, status, recurring, attempts, max_attempts, run_at, last_error,
+    result, COALESCE(locked_by, ''), created_at, started_at, finished_at`
+
+func scanJob(row scanner) (job, error) {
+	var j job
+	var payload []byte
+	err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Recurring, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.LastError,
+		&j.Result, &j.LockedBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	j.Payload = payload
+	return j, err
+}
+
+func queryJobs(query string, args ...any) ([]job, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// jobRetryDelay is how long to wait after a job's nth failed attempt.
+func jobRetryDelay(attempts int) time.Duration {
+	d := jobBaseDelay
+	for i := 1; i < attempts && d < jobMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, jobMaxDelay)
+}
+
+// jobRunner claims due jobs and runs them, within each kind's concurrency
+// limit. Jobs are claimed with SKIP LOCKED, so any number of instances can
+// share the queue.
+type jobRunner struct {
+	worker string
+
+	mu      sync.Mutex
+	running map[string]int
+	wg      sync.WaitGroup
+
+	// wake cuts the wait for the next poll short when a job finishes and
+	// frees a slot.
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// ctx is what running jobs see; it is cancelled when shutdown runs
+	// out of patience.
+	ctx       context.Context
+	interrupt context.CancelFunc
+}
+
+// startJobs makes sure every recurring kind has its job and starts
+// claiming jobs.
+func startJobs() (*jobRunner, error) {
+	for _, k := range jobKinds {
+		if k.Every == 0 {
+			continue
+		}
+		_, err := db.Exec(`
+            INSERT INTO jobs (kind, max_attempts, recurring) VALUES ($1, $2, true)
+            ON CONFLICT (kind) WHERE recurring DO UPDATE SET max_attempts = EXCLUDED.max_attempts`, k.Name, k.MaxAttempts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host, _ := os.Hostname()
+	ctx, interrupt := context.WithCancel(context.Background())
+	r := &jobRunner{
+		worker:    fmt.Sprintf("%s:%d", host, os.Getpid()),
+		running:   map[string]int{},
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		ctx:       ctx,
+		interrupt: interrupt,
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *jobRunner) loop() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		r.claimDue()
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// claimDue starts due jobs until there are none left or every kind is at
+// its limit.
+func (r *jobRunner) claimDue() {
+	if err := abandonExpired(); err != nil {
+		log.Printf("Failed to give up on expired jobs: %v", err)
+	}
+	for {
+		var kinds []string
+		var leases []float64
+		r.mu.Lock()
+		for _, k := range jobKinds {
+			if r.running[k.Name] < k.Concurrency {
+				kinds = append(kinds, k.Name)
+				leases = append(leases, (k.Timeout + jobLeaseMargin).Seconds())
+			}
+		}
+		r.mu.Unlock()
+		if len(kinds) == 0 {
+			return
+		}
+
+		j, err := r.claim(kinds, leases)
+		if errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim a job: %v", err)
+			return
+		}
+		k := jobKinds[j.Kind]
+		r.mu.Lock()
+		r.running[k.Name]++
+		r.mu.Unlock()
+		r.wg.Add(1)
+		go r.run(k, j)
+	}
+}
+
+// claim takes the oldest due job of one of kinds, along with any job whose
+// worker has held it past its lease and which has attempts left.
+func (r *jobRunner) claim(kinds []string, leases []float64) (job, error) {
+	return scanJob(db.QueryRow(`
+        WITH next AS (
+            SELECT jobs.id AS job_id, k.lease FROM jobs
+            JOIN unnest($1::text[], $2::float8[]) AS k(kind, lease) ON k.kind = jobs.kind
+            WHERE (jobs.status = 'queued' AND jobs.run_at <= now())
+               OR (jobs.status = 'running' AND jobs.locked_until < now() AND jobs.attempts < jobs.max_attempts)
+            ORDER BY jobs.run_at, jobs.id LIMIT 1
+            FOR UPDATE OF jobs SKIP LOCKED
+        )
+        UPDATE jobs SET status = 'running', attempts = attempts + 1, started_at = now(),
+            locked_by = $3, locked_until = now() + make_interval(secs => next.lease)
+        FROM next WHERE jobs.id = next.job_id
+        RETURNING `+jobColumns, pq.Array(kinds), pq.Array(leases), r.worker))
+}
+
+// abandonExpired settles jobs whose lease ran out on their last attempt.
+// Their worker most likely died running them, and running them again
+// could kill the next one too, so they fail the way finish fails them: a
+// recurring job waits for its next run and any other is marked failed.
+func abandonExpired() error {
+	var kinds []string
+	var every []float64
+	for _, k := range jobKinds {
+		kinds = append(kinds, k.Name)
+		every = append(every, k.Every.Seconds())
+	}
+	_, err := db.Exec(`
+        UPDATE jobs SET
+            status = CASE WHEN jobs.recurring THEN 'queued' ELSE 'failed' END,
+            attempts = CASE WHEN jobs.recurring THEN 0 ELSE jobs.attempts END,
+            run_at = CASE WHEN jobs.recurring THEN now() + make_interval(secs => k.every) ELSE jobs.run_at END,
+            finished_at = now(),
+            last_error = 'the worker running it stopped responding',
+            locked_by = NULL, locked_until = NULL
+        FROM unnest($1::text[], $2::float8[]) AS k(kind, every)
+        WHERE k.kind = jobs.kind AND jobs.status = 'running' AND jobs.locked_until < now()
+          AND jobs.attempts >= jobs.max_attempts`, pq.Array(kinds), pq.Array(every))
+	return err
+}
+
+func (r *jobRunner) run(k *jobKind, j job) {
+	defer func() {
+		r.mu.Lock()
+		r.running[k.Name]--
+		r.mu.Unlock()
+		r.wg.Done()
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(r.ctx, k.Timeout)
+	defer cancel()
+	var output bytes.Buffer
+	err := runJobHandler(context.WithValue(ctx, jobOutputKey{}, &output), k, j.Payload)
+	if err != nil && r.ctx.Err() == nil {
+		log.Printf("Job %d (%s) failed on attempt %d: %v", j.ID, j.Kind, j.Attempts, err)
+	}
+	if err := r.finish(k, j, err, output.String()); err != nil {
+		log.Printf("Failed to record the outcome of job %d (%s): %v", j.ID, j.Kind, err)
+	}
+}
+
+type jobOutputKey struct{}
+
+// jobOutput is where a job writes a report for staff. What an attempt
+// writes is kept as the job's result. Outside a job it goes nowhere.
+func jobOutput(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(jobOutputKey{}).(io.Writer); ok {
+		return w
+	}
+	return io.Discard
+}
+
+// runJobHandler runs a job, turning a panic into an error so one bad job
+// does not take the process down.
+func runJobHandler(ctx context.Context, k *jobKind, payload []byte) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return k.run(ctx, payload)
+}
+
+// finish records how an attempt went and what it wrote to its output. A
+// job interrupted by shutdown goes back in the queue without the attempt
+// counting against it, and keeps the result it had. The update
+// only applies while this worker still holds the job, in case its lease
+// ran out and another worker took it over.
+func (r *jobRunner) finish(k *jobKind, j job, runErr error, result string) error {
+	status, attempts, delay := "done", j.Attempts, time.Duration(0)
+	lastError := ""
+	switch {
+	case runErr != nil && r.ctx.Err() != nil:
+		status, attempts = "queued", j.Attempts-1
+		lastError, result = j.LastError, j.Result
+	case runErr == nil && j.Recurring:
+		status, attempts, delay = "queued", 0, k.Every
+	case runErr == nil:
+	case j.Attempts < j.MaxAttempts:
+		status, delay, lastError = "queued", jobRetryDelay(j.Attempts), runErr.Error()
+	case j.Recurring:
+		// A recurring job does not give up; it waits for its next run.
+		status, attempts, delay, lastError = "queued", 0, k.Every, runErr.Error()
+	default:
+		status, lastError = "failed", runErr.Error()
+	}
+	_, err := db.Exec(`
+        UPDATE jobs SET status = $1::text, attempts = $2, last_error = $3, result = $9,
+            run_at = CASE WHEN $1::text = 'queued' THEN now() + make_interval(secs => $4) ELSE run_at END,
+            finished_at = CASE WHEN $1::text = 'queued' AND $5::boolean THEN finished_at ELSE now() END,
+            locked_by = NULL, locked_until = NULL
+        WHERE id = $6 AND status = 'running' AND locked_by = $7 AND attempts = $8`,
+		status, attempts, lastError, delay.Seconds(), r.ctx.Err() != nil, j.ID, r.worker, j.Attempts, result)
+	return err
+}
+
+// Stop stops claiming jobs and waits for the running ones to finish. When
+// ctx ends first, they are interrupted and put back in the queue; handlers
+// are expected to give up promptly once their context is cancelled.
+func (r *jobRunner) Stop(ctx context.Context) {
+	close(r.stop)
+	<-r.stopped
+
+	idle := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return
+	case <-ctx.Done():
+	}
+	log.Printf("Interrupting running jobs")
+	r.interrupt()
+	<-idle
+}
+
+// pruneJobs forgets finished jobs older than jobRetention.
+func pruneJobs(ctx context.Context, _ struct{}) error {
+	res, err := db.ExecContext(ctx, `
+        DELETE FROM jobs
+        WHERE status IN ('done', 'cancelled') AND finished_at < now() - make_interval(secs => $1)`, jobRetention.Seconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Pruned %d finished jobs", n)
+	}
+	return nil
+}
+
+var pruneJobsJob = registerJob("prune_jobs", jobOptions{Every: purgeInterval}, pruneJobs)
+
+// getJobs lists jobs for staff: running and queued ones first, in the order
+// they are due, then the rest, latest first. ?status= narrows it to one
+// status.
+func getJobs(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage jobs"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && !slices.Contains(jobStatuses, status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of " + strings.Join(jobStatuses, ", ")})
+		return
+	}
+	jobs, err := queryJobs(`
+        SELECT `+jobColumns+` FROM jobs
+        WHERE $1::text = '' OR status = $1::text
+        ORDER BY status IN ('running', 'queued') DESC,
+            CASE WHEN status IN ('running', 'queued') THEN run_at END,
+            COALESCE(finished_at, created_at) DESC, id DESC
+        LIMIT $2`, status, jobListLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	counts := map[string]int{}
+	rows, err := db.Query("SELECT status, count(*) FROM jobs GROUP BY status")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		var n int
+		if err := rows.Scan(&s, &n); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		counts[s] = n
+	}
+	if err = rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch responseVariant(c) {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"counts": counts, "jobs": jobs})
+	default:
+		render(c, 200, JobsPage(jobs, counts, status))
+	}
+}
+
+// runJobNow makes a queued job due straight away, or gives a failed one a
+// fresh set of attempts.
+func runJobNow(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage jobs"})
+		return
+	}
+	j, err := scanJob(db.QueryRow(`
+        UPDATE jobs SET run_at = now(),
+            attempts = CASE WHEN status = 'failed' THEN 0 ELSE attempts END,
+            status = 'queued', finished_at = NULL
+        WHERE id = $1 AND status IN ('queued', 'failed')
+        RETURNING `+jobColumns, c.Param("jobID")))
+	if errors.Is(err, sql.ErrNoRows) {
+		jobNotChangeable(c, "only queued or failed jobs can be run now")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jobResponse(c, j)
+}
+
+// cancelJob stops a queued or failed job from running again. Recurring
+// jobs cannot be cancelled, and running ones have to be let finish.
+func cancelJob(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage jobs"})
+		return
+	}
+	j, err := scanJob(db.QueryRow(`
+        UPDATE jobs SET status = 'cancelled', finished_at = now()
+        WHERE id = $1 AND status IN ('queued', 'failed') AND NOT recurring
+        RETURNING `+jobColumns, c.Param("jobID")))
+	if errors.Is(err, sql.ErrNoRows) {
+		jobNotChangeable(c, "only queued or failed one-off jobs can be cancelled")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jobResponse(c, j)
+}
+
+// jobNotChangeable answers an action that matched no job: 404 if there is
+// no such job, 409 with msg if it is in the wrong state.
+func jobNotChangeable(c *gin.Context, msg string) {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM jobs WHERE id = $1)", c.Param("jobID")).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": msg})
+}
+
+func jobResponse(c *gin.Context, j job) {
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, jobRow(j))
+		return
+	}
+	c.JSON(http.StatusOK, j)
+}
@@ -1,26 +1,505 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/a-h/templ"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var db *sql.DB
 
+// shutdownTimeout is how long requests and running jobs get to finish
+// once the process is asked to stop. Docker waits 10s before killing it.
+const shutdownTimeout = 8 * time.Second
+
 type album struct {
-	ID     string  `json:"id"`
-	Title  string  `json:"title"`
-	Artist string  `json:"artist"`
-	Price  float64 `json:"price"`
+	ID      string  `json:"id"`
+	Title   string  `json:"title"`
+	Artist  string  `json:"artist"`
+	Price   float64 `json:"price"`
+	Version int64   `json:"version"`
+
+	// ArtistID is the canonical artist; Artist is a copy of its name.
+	ArtistID string `json:"artist_id"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	release
+	// Cover is the key of the album's cover art, empty if it has none.
+	Cover  string   `json:"cover,omitempty"`
+	Genres []string `json:"genres"`
+	Tags   []string `json:"tags"`
+
+	// Stock is the number of copies on hand, kept in step with the
+	// stock_ledger by adjustStock.
+	Stock             int `json:"stock"`
+	LowStockThreshold int `json:"low_stock_threshold"`
+}
+
+// LowStock reports whether the album is due for reordering.
+func (a album) LowStock() bool {
+	return a.Stock <= a.LowStockThreshold
+}
+
+// albumColumns lists the columns scanAlbum reads, in order.
+const albumColumns = `id, title, artist, price, version, COALESCE(artist_id::text, ''), created_at, updated_at, deleted_at,
+    COALESCE(release_year, 0), label, format, catalog_number, barcode, cover_key,
+    ARRAY(SELECT genres.name FROM album_genres JOIN genres ON genres.id = album_genres.genre_id
+          WHERE album_genres.album_id = albums.id ORDER BY lower(genres.name)),
+    ARRAY(SELECT tags.name FROM album_tags JOIN tags ON tags.id = album_tags.tag_id
+          WHERE album_tags.album_id = albums.id ORDER BY lower(tags.name)),
+    stock_on_hand, low_stock_threshold`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func scanAlbum(row scanner) (album, error) {
+	var a album
+	err := row.Scan(&a.ID, &a.Title, &a.Artist, &a.Price, &a.Version, &a.ArtistID, &a.CreatedAt, &a.UpdatedAt, &a.DeletedAt,
+		&a.Year, &a.Label, &a.Format, &a.CatalogNumber, &a.Barcode, &a.Cover, pq.Array(&a.Genres), pq.Array(&a.Tags),
+		&a.Stock, &a.LowStockThreshold)
+	return a, err
+}
+
+func queryAlbums(q querier, query string, args ...any) ([]album, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var albums []album
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// schema is applied in order on every start, so each statement must be
+// safe to run against a database that already has it.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS albums(
+        id SERIAL PRIMARY KEY,
+        title TEXT NOT NULL,
+        artist TEXT NOT NULL,
+        price DECIMAL(10,2) NOT NULL
+    )`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1`,
+	`CREATE TABLE IF NOT EXISTS album_catalog_state(
+        id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+        revision BIGINT NOT NULL DEFAULT 0,
+        modified_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`INSERT INTO album_catalog_state DEFAULT VALUES ON CONFLICT DO NOTHING`,
+	`CREATE OR REPLACE FUNCTION bump_album_catalog_state() RETURNS trigger AS $$
+    BEGIN
+        UPDATE album_catalog_state SET revision = revision + 1, modified_at = clock_timestamp();
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE TRIGGER albums_catalog_state
+        AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON albums
+        FOR EACH STATEMENT EXECUTE FUNCTION bump_album_catalog_state()`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS album_audit(
+        id BIGSERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL,
+        action TEXT NOT NULL,
+        actor TEXT NOT NULL,
+        request_id TEXT NOT NULL DEFAULT '',
+        before JSONB,
+        after JSONB,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE INDEX IF NOT EXISTS album_audit_album_id ON album_audit (album_id, id)`,
+	`CREATE OR REPLACE FUNCTION reject_album_audit_change() RETURNS trigger AS $$
+    BEGIN
+        RAISE EXCEPTION 'album_audit is append-only';
+    END;
+    $$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE TRIGGER album_audit_append_only
+        BEFORE UPDATE OR DELETE OR TRUNCATE ON album_audit
+        FOR EACH STATEMENT EXECUTE FUNCTION reject_album_audit_change()`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`CREATE INDEX IF NOT EXISTS albums_created_at ON albums (created_at)`,
+	`CREATE INDEX IF NOT EXISTS albums_updated_at ON albums (updated_at)`,
+	`CREATE TABLE IF NOT EXISTS tracks(
+        id SERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        disc_number INTEGER NOT NULL DEFAULT 1 CHECK (disc_number > 0),
+        position INTEGER NOT NULL CHECK (position > 0),
+        title TEXT NOT NULL,
+        duration_seconds INTEGER NOT NULL CHECK (duration_seconds >= 0),
+        isrc TEXT,
+        UNIQUE (album_id, disc_number, position) DEFERRABLE INITIALLY DEFERRED
+    )`,
+	`CREATE TABLE IF NOT EXISTS artists(
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        bio TEXT NOT NULL DEFAULT ''
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS artists_name ON artists (lower(name))`,
+	`CREATE TABLE IF NOT EXISTS artist_aliases(
+        id SERIAL PRIMARY KEY,
+        artist_id INTEGER NOT NULL REFERENCES artists(id) ON DELETE CASCADE,
+        alias TEXT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS artist_aliases_alias ON artist_aliases (lower(alias))`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS artist_id INTEGER REFERENCES artists(id)`,
+	`CREATE INDEX IF NOT EXISTS albums_artist_id ON albums (artist_id)`,
+	// Backfill artists from the free-text column. Spellings that differ only
+	// in case or spacing become one artist, named after the most common one.
+	`INSERT INTO artists (name)
+    SELECT DISTINCT ON (lower(name)) name
+    FROM (
+        SELECT regexp_replace(trim(artist), '\s+', ' ', 'g') AS name, count(*) AS uses
+        FROM albums
+        WHERE artist_id IS NULL
+        GROUP BY 1
+    ) spellings
+    ORDER BY lower(name), uses DESC, name
+    ON CONFLICT ((lower(name))) DO NOTHING`,
+	`UPDATE albums SET artist_id = artists.id, artist = artists.name
+    FROM artists
+    WHERE albums.artist_id IS NULL
+      AND lower(artists.name) = lower(regexp_replace(trim(albums.artist), '\s+', ' ', 'g'))`,
+	`CREATE TABLE IF NOT EXISTS genres(
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS genres_name ON genres (lower(name))`,
+	`CREATE TABLE IF NOT EXISTS album_genres(
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        genre_id INTEGER NOT NULL REFERENCES genres(id) ON DELETE CASCADE,
+        PRIMARY KEY (album_id, genre_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS album_genres_genre_id ON album_genres (genre_id, album_id)`,
+	`CREATE TABLE IF NOT EXISTS tags(
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS tags_name ON tags (lower(name))`,
+	`CREATE TABLE IF NOT EXISTS album_tags(
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+        PRIMARY KEY (album_id, tag_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS album_tags_tag_id ON album_tags (tag_id, album_id)`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS release_year INTEGER CHECK (release_year >= 1877)`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS label TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT ''
+        CONSTRAINT albums_format CHECK (format IN ('', 'vinyl', 'cd', 'cassette', 'digital'))`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS catalog_number TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS barcode TEXT NOT NULL DEFAULT ''`,
+	// A barcode identifies one pressing, as does a catalog number within a
+	// label, but the same release on CD and vinyl may share either. Trashed
+	// albums count, so that restoring one cannot collide.
+	`CREATE UNIQUE INDEX IF NOT EXISTS albums_format_barcode ON albums (format, barcode) WHERE barcode <> ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS albums_format_catalog_number
+        ON albums (format, lower(label), lower(catalog_number)) WHERE catalog_number <> ''`,
+	`CREATE INDEX IF NOT EXISTS albums_release_year ON albums (release_year)`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS cover_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS stock_on_hand INTEGER NOT NULL DEFAULT 0 CHECK (stock_on_hand >= 0)`,
+	`ALTER TABLE albums ADD COLUMN IF NOT EXISTS low_stock_threshold INTEGER NOT NULL DEFAULT 3 CHECK (low_stock_threshold >= 0)`,
+	// Every change to stock_on_hand is recorded here with the balance after
+	// it, so the ledger can be reconciled against the count.
+	`CREATE TABLE IF NOT EXISTS stock_ledger(
+        id BIGSERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        delta INTEGER NOT NULL CHECK (delta <> 0),
+        reason TEXT NOT NULL CHECK (reason IN ('received', 'sold', 'damaged', 'correction')),
+        note TEXT NOT NULL DEFAULT '',
+        balance INTEGER NOT NULL CHECK (balance >= 0),
+        actor TEXT NOT NULL,
+        request_id TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE INDEX IF NOT EXISTS stock_ledger_album_id ON stock_ledger (album_id, id)`,
+	`ALTER TABLE stock_ledger DROP CONSTRAINT IF EXISTS stock_ledger_reason_check,
+        ADD CONSTRAINT stock_ledger_reason_check
+        CHECK (reason IN ('received', 'sold', 'damaged', 'correction', 'reserved', 'released'))`,
+	`CREATE TABLE IF NOT EXISTS cart_items(
+        session_id TEXT NOT NULL,
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        quantity INTEGER NOT NULL CHECK (quantity > 0),
+        added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        PRIMARY KEY (session_id, album_id)
+    )`,
+	`CREATE INDEX IF NOT EXISTS cart_items_updated_at ON cart_items (updated_at)`,
+	`CREATE TABLE IF NOT EXISTS orders(
+        id SERIAL PRIMARY KEY,
+        session_id TEXT NOT NULL,
+        customer_name TEXT NOT NULL,
+        email TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending'
+            CHECK (status IN ('pending', 'paid', 'shipped', 'cancelled')),
+        total DECIMAL(10,2) NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        paid_at TIMESTAMPTZ,
+        shipped_at TIMESTAMPTZ,
+        cancelled_at TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS orders_session_id ON orders (session_id, id)`,
+	// Order lines copy what was bought so later edits to the album, or
+	// purging it, leave the order as it was.
+	`CREATE TABLE IF NOT EXISTS order_items(
+        order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+        line INTEGER NOT NULL,
+        album_id INTEGER REFERENCES albums(id) ON DELETE SET NULL,
+        title TEXT NOT NULL,
+        artist TEXT NOT NULL,
+        unit_price DECIMAL(10,2) NOT NULL,
+        quantity INTEGER NOT NULL CHECK (quantity > 0),
+        PRIMARY KEY (order_id, line)
+    )`,
+	`CREATE TABLE IF NOT EXISTS payments(
+        id SERIAL PRIMARY KEY,
+        order_id INTEGER NOT NULL REFERENCES orders(id),
+        provider TEXT NOT NULL,
+        idempotency_key TEXT NOT NULL UNIQUE,
+        reference TEXT NOT NULL DEFAULT '',
+        status TEXT NOT NULL
+            CHECK (status IN ('pending', 'authorized', 'captured', 'declined', 'refunded')),
+        amount DECIMAL(10,2) NOT NULL,
+        decline_reason TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE INDEX IF NOT EXISTS payments_order_id ON payments (order_id, id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS payments_reference ON payments (provider, reference) WHERE reference <> ''`,
+	`ALTER TABLE payments DROP CONSTRAINT IF EXISTS payments_status_check,
+        ADD CONSTRAINT payments_status_check
+        CHECK (status IN ('pending', 'authorized', 'captured', 'declined', 'refunded', 'failed'))`,
+	`CREATE TABLE IF NOT EXISTS payment_webhook_events(
+        provider TEXT NOT NULL,
+        event_id TEXT NOT NULL,
+        reference TEXT NOT NULL,
+        status TEXT NOT NULL,
+        received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        PRIMARY KEY (provider, event_id)
+    )`,
+	`CREATE TABLE IF NOT EXISTS price_history(
+        id BIGSERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        price DECIMAL(10,2) NOT NULL,
+        changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE INDEX IF NOT EXISTS price_history_album_id ON price_history (album_id, changed_at)`,
+	// A trigger rather than the handlers records prices, so no way of
+	// changing one can skip it.
+	`CREATE OR REPLACE FUNCTION record_album_price() RETURNS trigger AS $$
+    BEGIN
+        IF TG_OP = 'INSERT' OR NEW.price IS DISTINCT FROM OLD.price THEN
+            INSERT INTO price_history (album_id, price) VALUES (NEW.id, NEW.price);
+        END IF;
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE TRIGGER albums_price_history
+        AFTER INSERT OR UPDATE OF price ON albums
+        FOR EACH ROW EXECUTE FUNCTION record_album_price()`,
+	// Albums from before price history start it with their current price.
+	`INSERT INTO price_history (album_id, price, changed_at)
+        SELECT id, price, created_at FROM albums
+        WHERE NOT EXISTS (SELECT 1 FROM price_history WHERE price_history.album_id = albums.id)`,
+	`CREATE TABLE IF NOT EXISTS price_schedules(
+        id SERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+        kind TEXT NOT NULL CHECK (kind IN ('change', 'sale')),
+        price DECIMAL(10,2) NOT NULL CHECK (price >= 0),
+        starts_at TIMESTAMPTZ NOT NULL,
+        ends_at TIMESTAMPTZ,
+        status TEXT NOT NULL DEFAULT 'scheduled'
+            CHECK (status IN ('scheduled', 'active', 'done', 'cancelled')),
+        original_price DECIMAL(10,2),
+        actor TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        CHECK ((kind = 'sale') = (ends_at IS NOT NULL))
+    )`,
+	`CREATE INDEX IF NOT EXISTS price_schedules_due ON price_schedules (starts_at) WHERE status IN ('scheduled', 'active')`,
+	`CREATE INDEX IF NOT EXISTS price_schedules_album_id ON price_schedules (album_id, starts_at)`,
+	// A promotion without a code applies by itself. Genre matches an
+	// album's genres by name, as the browse filters do.
+	`CREATE TABLE IF NOT EXISTS promotions(
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        code TEXT NOT NULL DEFAULT '',
+        kind TEXT NOT NULL CHECK (kind IN ('percent', 'fixed', 'buy_x_get_y')),
+        amount DECIMAL(10,2) NOT NULL DEFAULT 0 CHECK (amount >= 0),
+        artist_id INTEGER REFERENCES artists(id) ON DELETE CASCADE,
+        genre TEXT NOT NULL DEFAULT '',
+        buy_quantity INTEGER NOT NULL DEFAULT 0,
+        get_quantity INTEGER NOT NULL DEFAULT 0,
+        min_total DECIMAL(10,2) NOT NULL DEFAULT 0,
+        starts_at TIMESTAMPTZ,
+        ends_at TIMESTAMPTZ,
+        usage_limit INTEGER CHECK (usage_limit > 0),
+        times_used INTEGER NOT NULL DEFAULT 0 CHECK (times_used >= 0),
+        active BOOLEAN NOT NULL DEFAULT true,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS promotions_code ON promotions (lower(code)) WHERE code <> ''`,
+	`CREATE TABLE IF NOT EXISTS cart_codes(
+        session_id TEXT PRIMARY KEY,
+        code TEXT NOT NULL,
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount DECIMAL(10,2) NOT NULL DEFAULT 0`,
+	`ALTER TABLE order_items ADD COLUMN IF NOT EXISTS discount DECIMAL(10,2) NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS promotion_redemptions(
+        order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+        promotion_id INTEGER NOT NULL REFERENCES promotions(id),
+        discount DECIMAL(10,2) NOT NULL,
+        PRIMARY KEY (order_id, promotion_id)
+    )`,
+	// Every change to a live album is recorded and notified on the albums
+	// channel, whichever instance or tool made it. Changes to albums in
+	// the trash are not: they are not shown anywhere live. Trashing counts
+	// as deleting and restoring as creating.
+	//
+	// The changes feed needs ids in commit order, so a reader that has seen
+	// a change can never later find one below it. The trigger is therefore
+	// deferred to commit time and takes a lock that lasts until the commit
+	// is visible before it numbers the change. Row locks are all held by
+	// then, so waiting for it cannot deadlock.
+	`CREATE TABLE IF NOT EXISTS album_changes(
+        id BIGSERIAL PRIMARY KEY,
+        album_id INTEGER NOT NULL,
+        kind TEXT NOT NULL CHECK (kind IN ('created', 'updated', 'deleted')),
+        changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	`CREATE INDEX IF NOT EXISTS album_changes_changed_at ON album_changes (changed_at)`,
+	`CREATE OR REPLACE FUNCTION record_album_change() RETURNS trigger AS $$
+    DECLARE
+        change album_changes;
+    BEGIN
+        IF TG_OP = 'DELETE' THEN
+            IF OLD.deleted_at IS NOT NULL THEN
+                RETURN NULL;
+            END IF;
+            change.album_id := OLD.id;
+            change.kind := 'deleted';
+        ELSIF TG_OP = 'INSERT' OR OLD.deleted_at IS NOT NULL THEN
+            IF NEW.deleted_at IS NOT NULL THEN
+                RETURN NULL;
+            END IF;
+            change.album_id := NEW.id;
+            change.kind := 'created';
+        ELSE
+            change.album_id := NEW.id;
+            change.kind := CASE WHEN NEW.deleted_at IS NULL THEN 'updated' ELSE 'deleted' END;
+        END IF;
+        PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+        INSERT INTO album_changes (album_id, kind) VALUES (change.album_id, change.kind)
+            RETURNING * INTO change;
+        PERFORM pg_notify('` + albumsChannel + `',
+            json_build_object('id', change.id, 'kind', change.kind, 'album_id', change.album_id::text)::text);
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS albums_changes ON albums`,
+	`CREATE CONSTRAINT TRIGGER albums_changes
+        AFTER INSERT OR UPDATE OR DELETE ON albums
+        DEFERRABLE INITIALLY DEFERRED
+        FOR EACH ROW EXECUTE FUNCTION record_album_change()`,
+	// Changes up to this id have been pruned, so a feed cursor below it
+	// can no longer be resumed.
+	`ALTER TABLE album_catalog_state ADD COLUMN IF NOT EXISTS changes_pruned_through BIGINT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS webhook_endpoints(
+        id SERIAL PRIMARY KEY,
+        url TEXT NOT NULL,
+        description TEXT NOT NULL DEFAULT '',
+        events TEXT[] NOT NULL DEFAULT '{}',
+        secret TEXT NOT NULL,
+        active BOOLEAN NOT NULL DEFAULT true,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`,
+	// The outbox: a row per event per endpoint, written with the change
+	// that caused it and kept as the delivery log once sent. payload is
+	// text so every attempt signs and sends the same bytes.
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries(
+        id BIGSERIAL PRIMARY KEY,
+        endpoint_id INTEGER NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+        event_id TEXT NOT NULL,
+        event TEXT NOT NULL,
+        album_id INTEGER NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+        attempts INTEGER NOT NULL DEFAULT 0,
+        next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        last_attempt_at TIMESTAMPTZ,
+        response_status INTEGER,
+        last_error TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        delivered_at TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_id ON webhook_deliveries (endpoint_id, id)`,
+	`CREATE TABLE IF NOT EXISTS jobs (
+        id BIGSERIAL PRIMARY KEY,
+        kind TEXT NOT NULL,
+        payload JSONB NOT NULL DEFAULT '{}',
+        status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'done', 'failed', 'cancelled')),
+        recurring BOOLEAN NOT NULL DEFAULT false,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        max_attempts INTEGER NOT NULL CHECK (max_attempts > 0),
+        run_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        last_error TEXT NOT NULL DEFAULT '',
+        result TEXT NOT NULL DEFAULT '',
+        locked_by TEXT,
+        locked_until TIMESTAMPTZ,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        started_at TIMESTAMPTZ,
+        finished_at TIMESTAMPTZ
+    )`,
+	`CREATE INDEX IF NOT EXISTS jobs_due ON jobs (run_at) WHERE status IN ('queued', 'running')`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS jobs_recurring_kind ON jobs (kind) WHERE recurring`,
+	// Customers all act as anonymous, so their keys are told apart by
+	// session.
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+        actor TEXT NOT NULL,
+        session_id TEXT NOT NULL DEFAULT '',
+        key TEXT NOT NULL,
+        fingerprint TEXT NOT NULL,
+        status INTEGER,
+        header JSONB,
+        body BYTEA,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        expires_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (actor, session_id, key)
+    )`,
+	`CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at ON idempotency_keys (expires_at)`,
 }
 
 func main() {
@@ -80,28 +559,162 @@ func main() {
 		log.Fatal("Failed to connect to database after multiple attempts:", err)
 	}
 
-	createTableSQL := `CREATE TABLE IF NOT EXISTS albums(
-        id SERIAL PRIMARY KEY,
-        title TEXT NOT NULL,
-        artist TEXT NOT NULL,
-        price DECIMAL(10,2) NOT NULL
-    )`
+	for _, stmt := range schema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			log.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	fmt.Println("Table created successfully!")
+
+	if len(os.Args) > 1 && os.Args[1] == "import-library" {
+		if err = importLibrary(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	_, err = db.Exec(createTableSQL)
+	blobs, err = newBlobStore()
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+
+	payments, err = newPaymentProvider()
+	if err != nil {
+		log.Fatalf("Failed to set up payments: %v", err)
+	}
+	if payments == nil {
+		log.Printf("PAYMENT_PROVIDER is not set, so orders cannot be paid")
+	}
+
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		trashRetention, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid TRASH_RETENTION: %v", err)
+		}
+	}
+	if v := os.Getenv("CHANGE_RETENTION"); v != "" {
+		changeRetention, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid CHANGE_RETENTION: %v", err)
+		}
+	}
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	go listenForChanges(psqlInfo)
+
+	grpcToken = os.Getenv("GRPC_TOKEN")
+	grpcAddr := os.Getenv("GRPC_ADDR")
+	if grpcAddr == "" {
+		grpcAddr = defaultGRPCAddr
+	}
+
+	// Housekeeping, webhook delivery and queued imports all run as jobs.
+	workers, err := startJobs()
+	if err != nil {
+		log.Fatalf("Failed to start job workers: %v", err)
 	}
-	fmt.Println("Table created successfully!")
 
 	router := gin.Default()
-	router.GET("/", getAlbums)
-	router.GET("/:id", getAlbumByID)
-	router.POST("/", postAlbums)
-	router.PUT("/:id", updateAlbumByID)
-	router.DELETE("/:id", deleteAlbumByID)
+	router.Use(forwardedUser(), requestID(), timeZone(), promotionPrices())
+	router.GET("/", cachePolicy("no-cache", "HX-Request", "Accept", "Cookie"), getAlbums)
+	router.GET("/events", cachePolicy("no-store"), streamEvents)
+	router.GET("/changes", cachePolicy("no-store"), getChanges)
+	router.GET("/:id", cachePolicy("no-cache", "HX-Request", "getReq", "Accept", "Cookie"), getAlbumByID)
+	router.POST("/", cachePolicy("no-store"), limitBody(maxAlbumRequest, errCoverTooLarge), idempotent(), postAlbums)
+	router.PUT("/:id", cachePolicy("no-store"), limitBody(maxAlbumRequest, errCoverTooLarge), updateAlbumByID)
+	router.DELETE("/:id", cachePolicy("no-store"), deleteAlbumByID)
+	router.POST("/batch", cachePolicy("no-store"), limitBody(maxBatchRequest, errBatchTooLarge), idempotent(), postBatch)
+	router.POST("/graphql", cachePolicy("no-store"), limitBody(maxGraphQLRequest, errGraphQLTooLarge), postGraphQL)
+	router.GET("/trash", cachePolicy("no-cache", "HX-Request", "Accept"), getTrash)
+	router.POST("/trash/:id/restore", cachePolicy("no-store"), restoreAlbumByID)
+	router.DELETE("/trash/:id", cachePolicy("no-store"), purgeAlbumByID)
+	router.GET("/:id/history", cachePolicy("no-cache", "Accept"), getAlbumHistory)
+	router.GET("/audit", cachePolicy("no-cache", "HX-Request", "Accept"), getAuditFeed)
+	router.GET("/:id/tracks", cachePolicy("no-cache", "HX-Request"), getTracks)
+	router.POST("/:id/tracks", cachePolicy("no-store"), idempotent(), postTrack)
+	router.POST("/:id/tracks/order", cachePolicy("no-store"), reorderTracks)
+	router.GET("/:id/tracks/:trackID", cachePolicy("no-cache", "getReq"), getTrackByID)
+	router.PUT("/:id/tracks/:trackID", cachePolicy("no-store"), updateTrackByID)
+	router.DELETE("/:id/tracks/:trackID", cachePolicy("no-store"), deleteTrackByID)
+	router.GET("/artists", cachePolicy("no-cache", "Accept"), getArtists)
+	router.GET("/artists/suggest", cachePolicy("no-cache", "HX-Request"), suggestArtists)
+	router.GET("/artists/:artistID", cachePolicy("no-cache", "Accept"), getArtistByID)
+	router.PUT("/artists/:artistID", cachePolicy("no-store"), updateArtistByID)
+	router.POST("/artists/:artistID/aliases", cachePolicy("no-store"), idempotent(), postArtistAlias)
+	router.DELETE("/artists/:artistID/aliases/:aliasID", cachePolicy("no-store"), deleteArtistAlias)
+	router.GET("/recent", cachePolicy("no-cache", "HX-Request", "Accept"), getRecent)
+	router.POST("/preferences/timezone", cachePolicy("no-store"), setTimeZone)
+	router.GET("/covers/:name", cachePolicy("public, max-age=31536000, immutable"), getCover)
+	router.GET("/inventory", cachePolicy("no-cache", "Accept"), getInventory)
+	router.GET("/:id/prices", cachePolicy("no-cache", "HX-Request"), getPrices)
+	router.POST("/:id/prices/schedules", cachePolicy("no-store"), idempotent(), postPriceSchedule)
+	router.DELETE("/:id/prices/schedules/:scheduleID", cachePolicy("no-store"), deletePriceSchedule)
+	router.GET("/:id/stock", cachePolicy("no-cache", "HX-Request"), getStockLedger)
+	router.POST("/:id/stock", cachePolicy("no-store"), idempotent(), postStockAdjustment)
+	router.PUT("/:id/stock/threshold", cachePolicy("no-store"), updateLowStockThreshold)
+	router.GET("/cart", cachePolicy("private, no-cache", "HX-Request", "Accept"), getCart)
+	router.GET("/cart/count", cachePolicy("private, no-cache"), getCartCount)
+	router.POST("/cart/items", cachePolicy("no-store"), idempotent(), postCartItem)
+	router.PUT("/cart/items/:albumID", cachePolicy("no-store"), updateCartItem)
+	router.DELETE("/cart/items/:albumID", cachePolicy("no-store"), deleteCartItem)
+	router.POST("/cart/code", cachePolicy("no-store"), postCartCode)
+	router.DELETE("/cart/code", cachePolicy("no-store"), deleteCartCode)
+	router.POST("/checkout", cachePolicy("no-store"), idempotent(), checkout)
+	router.GET("/orders", cachePolicy("private, no-cache", "Accept"), getOrders)
+	router.GET("/orders/:orderID", cachePolicy("private, no-cache", "HX-Request", "Accept"), getOrderByID)
+	router.PUT("/orders/:orderID/status", cachePolicy("no-store"), updateOrderStatus)
+	router.POST("/orders/:orderID/payments", cachePolicy("no-store"), idempotent(), postPayment)
+	router.POST("/payments/webhook", cachePolicy("no-store"), paymentWebhook)
+	router.GET("/promotions", cachePolicy("private, no-cache", "HX-Request", "Accept"), getPromotions)
+	router.POST("/promotions", cachePolicy("no-store"), idempotent(), postPromotion)
+	router.DELETE("/promotions/:promotionID", cachePolicy("no-store"), deletePromotion)
+	router.GET("/webhooks", cachePolicy("private, no-cache", "HX-Request", "Accept"), getWebhooks)
+	router.POST("/webhooks", cachePolicy("no-store"), idempotent(), postWebhook)
+	router.DELETE("/webhooks/:webhookID", cachePolicy("no-store"), deleteWebhook)
+	router.GET("/webhooks/:webhookID/deliveries", cachePolicy("private, no-cache", "Accept"), getWebhookDeliveries)
+	router.POST("/webhooks/:webhookID/deliveries/:deliveryID/redeliver", cachePolicy("no-store"), idempotent(), redeliverWebhook)
+	router.GET("/jobs", cachePolicy("private, no-cache", "Accept"), getJobs)
+	router.POST("/jobs/:jobID/run", cachePolicy("no-store"), runJobNow)
+	router.DELETE("/jobs/:jobID", cachePolicy("no-store"), cancelJob)
+	router.GET("/debug/vars", cachePolicy("no-store"), getMetrics)
 
 	// Changed from localhost:8080 to :8080 to listen on all interfaces
-	router.Run(":8080")
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	// Event streams and long polls never go idle by themselves, so they
+	// are told to wind up as soon as shutdown starts.
+	srv.RegisterOnShutdown(func() { close(serverClosing) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+	var rpc *grpcServer
+	if grpcToken == "" {
+		log.Printf("GRPC_TOKEN is not set, so AlbumService is not served")
+	} else if rpc, err = startGRPC(grpcAddr); err != nil {
+		log.Fatalf("Failed to start gRPC server: %v", err)
+	}
+	<-ctx.Done()
+	stop()
+
+	// Requests are finished first, so nothing new is queued while the
+	// workers drain.
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err = srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish requests before shutting down: %v", err)
+	}
+	if rpc != nil {
+		rpc.Stop(shutdownCtx)
+	}
+	workers.Stop(shutdownCtx)
 }
 
 func render(c *gin.Context, status int, template templ.Component) error {
@@ -109,91 +722,364 @@ func render(c *gin.Context, status int, template templ.Component) error {
 	return template.Render(c.Request.Context(), c.Writer)
 }
 
+// responseVariant picks the representation for a listing: a full page, the
+// htmx fragment that replaces the list, or JSON for API clients.
+func responseVariant(c *gin.Context) string {
+	switch {
+	case c.GetHeader("HX-Request") == "true":
+		return "fragment"
+	case c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON:
+		return "json"
+	default:
+		return "page"
+	}
+}
+
 func getAlbums(c *gin.Context) {
-	rows, err := db.Query("SELECT id, title, artist, price FROM albums")
+	variant := responseVariant(c)
+
+	// The state is read before the rows, so a concurrent write can only make
+	// the ETag older than the body, never newer.
+	revision, modified, err := catalogState()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
+	// Cards show dates in the user's time zone, and prices after running
+	// promotions, so both are part of the tag.
+	zone := userLocation(c.Request.Context()).String()
+	promotions, err := shelfPromotionsTag(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if notModified(c, fmt.Sprintf(`"catalog-%d-%s-%s-%s"`, revision, variant, zone, promotions), modified) {
+		return
+	}
 
-	var albums []album
-	for rows.Next() {
-		var a album
-		if err := rows.Scan(&a.ID, &a.Title, &a.Artist, &a.Price); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		albums = append(albums, a)
+	filter := parseBrowseFilter(c)
+	albums, err := listAlbums(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if variant == "json" {
+		c.JSON(http.StatusOK, albums)
+		return
 	}
-	if err = rows.Err(); err != nil {
+	fs, err := loadFacets(filter)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if c.GetHeader("HX-Request") == "true" {
-		render(c, 200, AlbumsDiv(albums))
+	if variant == "fragment" {
+		render(c, 200, templ.Join(AlbumsDiv(albums, filter), Facets(fs, true)))
 		return
 	}
-	render(c, 200, MainTemp(AlbumsDiv(albums)))
+	render(c, 200, MainTemp(AlbumsDiv(albums, filter), fs))
 }
 
 func postAlbums(c *gin.Context) {
-	if title := c.PostForm("title"); title == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+	var newAlbum album
+	if err := bindAlbumFields(c.GetPostForm, &newAlbum); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if artist := c.PostForm("artist"); artist == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "artist is required"})
+	genres, tags, err := bindAlbumTerms(c.GetPostForm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	var newAlbum album
-	newAlbum.Title = c.PostForm("title")
-	newAlbum.Artist = c.PostForm("artist")
-	price := c.PostForm("price")
-	var err error
-	newAlbum.Price, err = strconv.ParseFloat(price, 64)
+	if err = bindRelease(c.GetPostForm, &newAlbum.release); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cover, err := readCover(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+		c.JSON(coverErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	insertSQL := `INSERT INTO albums (title, artist, price) VALUES ($1, $2, $3) RETURNING id;`
-	var id int
-	err = db.QueryRow(insertSQL, newAlbum.Title, newAlbum.Artist, newAlbum.Price).Scan(&id)
+	newAlbum, err = createAlbum(c.Request.Context(), requestAuditor(c), newAlbum, genres, tags, cover)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		albumWriteError(c, err)
 		return
 	}
-	newAlbum.ID = fmt.Sprintf("%d", id)
+
+	c.Header("ETag", albumETag(newAlbum))
 	render(c, 200, Album(newAlbum))
 }
 
+// albumValues looks up a field of an album write by its form name,
+// reporting whether it was sent at all. Forms pass c.GetPostForm; the
+// GraphQL mutations pass their input, so both are validated alike.
+type albumValues func(name string) (string, bool)
+
+// bindAlbumFields reads the title, artist and price every write carries.
+func bindAlbumFields(get albumValues, a *album) error {
+	title, _ := get("title")
+	if title == "" {
+		return errors.New("title is required")
+	}
+	artist, _ := get("artist")
+	// resolveArtist would normalize a blank name to nothing.
+	artist = normalizeArtistName(artist)
+	if artist == "" {
+		return errors.New("artist is required")
+	}
+	price, _ := get("price")
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return errors.New("Invalid price")
+	}
+	a.Title, a.Artist, a.Price = title, artist, p
+	return nil
+}
+
+// errAlbumNotFound is returned by album writes for albums that do not
+// exist or are in the trash.
+var errAlbumNotFound = errors.New("album not found")
+
+// albumConflict is returned by album writes when the album is no longer
+// at the version the writer expected. Mine is the rejected update, or nil
+// for deletes.
+type albumConflict struct {
+	current album
+	mine    *album
+}
+
+func (albumConflict) Error() string { return "album has been modified" }
+
+// invalidAlbum wraps validation errors found once an album write is
+// under way.
+type invalidAlbum struct{ error }
+
+// albumWriteError answers a failed createAlbum, updateAlbum or
+// deleteAlbum.
+func albumWriteError(c *gin.Context, err error) {
+	var conflictErr albumConflict
+	var invalid invalidAlbum
+	switch {
+	case errors.Is(err, errAlbumNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &conflictErr):
+		conflict(c, conflictErr.current, conflictErr.mine)
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		if msg, ok := releaseConflict(err); ok {
+			c.JSON(http.StatusConflict, gin.H{"error": msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// createAlbum stores a new album, crediting it to the artist its name
+// resolves to. cover may be nil.
+func createAlbum(ctx context.Context, who auditor, newAlbum album, genres, tags []string, cover *coverImages) (album, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return album{}, err
+	}
+	defer tx.Rollback()
+
+	if newAlbum, err = insertAlbum(ctx, tx, who, newAlbum, genres, tags, cover); err != nil {
+		return album{}, err
+	}
+	return newAlbum, tx.Commit()
+}
+
+// insertAlbum is createAlbum in tx, for writes that make more than one
+// change at once.
+func insertAlbum(ctx context.Context, tx *sql.Tx, who auditor, newAlbum album, genres, tags []string, cover *coverImages) (album, error) {
+	art, err := resolveArtist(tx, newAlbum.Artist)
+	if err != nil {
+		return album{}, err
+	}
+
+	insertSQL := `
+        INSERT INTO albums (title, artist, artist_id, price, release_year, label, format, catalog_number, barcode, cover_key)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7, $8, $9, $10)
+        RETURNING ` + albumColumns + `;`
+	// The files are stored before the row is committed, so the album never
+	// refers to a cover that is not there yet.
+	if cover != nil {
+		if newAlbum.Cover, err = saveCover(ctx, cover); err != nil {
+			return album{}, err
+		}
+	}
+	r := newAlbum.release
+	newAlbum, err = scanAlbum(tx.QueryRow(insertSQL, newAlbum.Title, art.Name, art.ID, newAlbum.Price,
+		r.Year, r.Label, r.Format, r.CatalogNumber, r.Barcode, newAlbum.Cover))
+	if err != nil {
+		return album{}, err
+	}
+	if genres != nil || tags != nil {
+		if err = setAlbumTerms(tx, genreTerms, newAlbum.ID, genres); err != nil {
+			return album{}, err
+		}
+		if err = setAlbumTerms(tx, tagTerms, newAlbum.ID, tags); err != nil {
+			return album{}, err
+		}
+		if newAlbum, err = scanAlbum(tx.QueryRow("SELECT "+albumColumns+" FROM albums WHERE id = $1", newAlbum.ID)); err != nil {
+			return album{}, err
+		}
+	}
+	if err = who.record(tx, "create", nil, &newAlbum); err != nil {
+		return album{}, err
+	}
+	return newAlbum, nil
+}
+
 func deleteAlbumByID(c *gin.Context) {
 	id := c.Param("id")
-	deleteSQL := `DELETE FROM albums WHERE id = $1;`
-	res, err := db.Exec(deleteSQL, id)
+	versions, anyVersion, ok := expectedVersions(c, id)
+	if !ok {
+		preconditionRequired(c)
+		return
+	}
+	deleted, err := deleteAlbum(c.Request.Context(), requestAuditor(c), id, versions, anyVersion)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		albumWriteError(c, err)
+		return
+	}
+
+	if c.GetHeader("HX-Request") != "true" {
+		getAlbums(c)
 		return
 	}
-	rowsAffected, err := res.RowsAffected()
+	// The button sends the facet selection, so the grid keeps its filter.
+	filter := parseBrowseFilter(c)
+	albums, err := listAlbums(filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+	fs, err := loadFacets(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	getAlbums(c)
+	render(c, 200, templ.Join(AlbumsDiv(albums, filter), Facets(fs, true), UndoToast(deleted)))
+}
+
+// deleteAlbum moves an album to the trash if it is at one of versions.
+func deleteAlbum(ctx context.Context, who auditor, id string, versions []int64, anyVersion bool) (album, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return album{}, err
+	}
+	defer tx.Rollback()
+
+	deleted, err := trashAlbum(tx, who, id, versions, anyVersion)
+	if err != nil {
+		return album{}, err
+	}
+	return deleted, tx.Commit()
+}
+
+// trashAlbum is deleteAlbum in tx.
+func trashAlbum(tx *sql.Tx, who auditor, id string, versions []int64, anyVersion bool) (album, error) {
+	current, err := lockAlbum(tx, id)
+	if err == sql.ErrNoRows {
+		return album{}, errAlbumNotFound
+	}
+	if err != nil {
+		return album{}, err
+	}
+	if !versionMatches(versions, anyVersion, current.Version) {
+		return album{}, albumConflict{current: current}
+	}
+
+	// Deleting only moves the album to the trash; purgeTrash removes it for
+	// good once the retention period has passed.
+	deleteSQL := `
+        UPDATE albums
+        SET deleted_at = now(), updated_at = now(), version = version + 1
+        WHERE id = $1
+        RETURNING ` + albumColumns + `;
+	`
+	deleted, err := scanAlbum(tx.QueryRow(deleteSQL, id))
+	if err != nil {
+		return album{}, err
+	}
+	if err = who.record(tx, "delete", &current, &deleted); err != nil {
+		return album{}, err
+	}
+	return deleted, nil
+}
+
+func listAlbums(f browseFilter) ([]album, error) {
+	where, args := f.where("")
+	return queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE "+where+" ORDER BY id", args...)
+}
+
+const (
+	defaultAlbumPage = 20
+	maxAlbumPage     = 100
+)
+
+// albumPage is a page of albums for the GraphQL and gRPC APIs. Next is the
+// cursor of the page after it, empty on the last page.
+type albumPage struct {
+	albums []album
+	total  int
+	next   string
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// pageAlbums reads the page of size albums matching f that comes after
+// cursor, or the first page if cursor is empty. Pages are in id order, so
+// a cursor is an album id, encoded to keep clients from relying on that.
+func pageAlbums(ctx context.Context, f browseFilter, cursor string, size int) (albumPage, error) {
+	where, args := f.where("")
+	var page albumPage
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM albums WHERE "+where, args...).Scan(&page.total); err != nil {
+		return page, err
+	}
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		id, ok := strings.CutPrefix(string(b), "album:")
+		if err != nil || !ok {
+			return page, errInvalidCursor
+		}
+		after, err := strconv.Atoi(id)
+		if err != nil {
+			return page, errInvalidCursor
+		}
+		args = append(args, after)
+		where += fmt.Sprintf(" AND albums.id > $%d", len(args))
+	}
+	// One more than the page tells whether there is another.
+	args = append(args, size+1)
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE "+where+fmt.Sprintf(" ORDER BY albums.id LIMIT $%d", len(args)), args...)
+	if err != nil {
+		return page, err
+	}
+	if len(albums) > size {
+		albums = albums[:size]
+		page.next = base64.RawURLEncoding.EncodeToString([]byte("album:" + albums[size-1].ID))
+	}
+	page.albums = albums
+	return page, nil
+}
+
+func fetchAlbum(id string) (album, error) {
+	return scanAlbum(db.QueryRow("SELECT "+albumColumns+" FROM albums WHERE id = $1 AND deleted_at IS NULL", id))
+}
+
+// lockAlbum reads a live album and holds its row lock until tx ends, so
+// the version it returns is still current when tx writes.
+func lockAlbum(tx *sql.Tx, id string) (album, error) {
+	return scanAlbum(tx.QueryRow("SELECT "+albumColumns+" FROM albums WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id))
 }
 
 func getAlbumByID(c *gin.Context) {
-	var a album
 	id := c.Param("id")
-	err := db.QueryRow("SELECT id, title, artist, price FROM albums WHERE id = $1", id).Scan(&a.ID, &a.Title, &a.Artist, &a.Price)
+	a, err := fetchAlbum(id)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
 		return
@@ -203,59 +1089,169 @@ func getAlbumByID(c *gin.Context) {
 		return
 	}
 
-	header := c.GetHeader("getReq")
-	if header == "update" {
-		render(c, 200, UpdateForm(a))
+	// Browsers get the detail page. It lists tracks, which do not change the
+	// album's version, so it is not validated by the album's ETag.
+	view := c.GetHeader("getReq")
+	if view == "" && c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		tracks, err := queryTracks(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		render(c, 200, AlbumPage(a, tracks))
+		return
+	}
+
+	// The form, the card and the JSON are different bodies, so each has
+	// its own tag. Cards show dates in the user's time zone, prices after
+	// running promotions, and stock, which moves without a new version.
+	variant := view
+	if variant == "" {
+		variant = "json"
+	}
+	zone := userLocation(c.Request.Context()).String()
+	promotions, err := shelfPromotionsTag(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stock := fmt.Sprintf("%d.%d", a.Stock, a.LowStockThreshold)
+	if notModified(c, albumViewETag(a, variant, zone, promotions, stock), time.Time{}) {
+		return
 	}
-	if header == "cancel" {
+	switch view {
+	case "update":
+		render(c, 200, UpdateForm(a))
+	case "cancel":
 		render(c, 200, Album(a))
+	default:
+		c.JSON(http.StatusOK, a)
 	}
 }
 
 func updateAlbumByID(c *gin.Context) {
-	if title := c.PostForm("title"); title == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+	a := album{ID: c.Param("id")}
+	if err := bindAlbumFields(c.GetPostForm, &a); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if artist := c.PostForm("artist"); artist == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "artist is required"})
+	versions, anyVersion, ok := expectedVersions(c, a.ID)
+	if !ok {
+		preconditionRequired(c)
 		return
 	}
-
-	var a album
-	id := c.Param("id")
-	updateSQL := `
-        UPDATE albums
-        SET title = $1, artist = $2, price = $3 
-        WHERE id = $4;
-	`
-	a.Title = c.Request.FormValue("title")
-	a.Artist = c.Request.FormValue("artist")
-	price := c.Request.FormValue("price")
-	var err error
-	a.Price, err = strconv.ParseFloat(price, 64)
+	genres, tags, err := bindAlbumTerms(c.GetPostForm)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	res, err := db.Exec(updateSQL, a.Title, a.Artist, a.Price, id)
+	cover, err := readCover(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(coverErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	updated, err := updateAlbum(c.Request.Context(), requestAuditor(c), a, versions, anyVersion, c.GetPostForm, genres, tags, cover)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		albumWriteError(c, err)
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
-		return
+
+	c.Header("ETag", albumETag(updated))
+	render(c, 200, Album(updated))
+}
+
+// updateAlbum saves a, whose title, artist and price are already bound,
+// if the album is at one of versions. Release fields, genres and tags the
+// write left out keep their stored values; cover may be nil.
+func updateAlbum(ctx context.Context, who auditor, a album, versions []int64, anyVersion bool, get albumValues, genres, tags []string, cover *coverImages) (album, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return album{}, err
+	}
+	defer tx.Rollback()
+
+	current, updated, err := saveAlbum(ctx, tx, who, a, versions, anyVersion, get, genres, tags, cover)
+	if err != nil {
+		return album{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return album{}, err
+	}
+
+	if current.Cover != updated.Cover {
+		removeCover(current.Cover)
+	}
+	return updated, nil
+}
+
+// saveAlbum is updateAlbum in tx. It returns the album as it was too, and
+// the caller removes the old cover once tx commits if it was replaced.
+func saveAlbum(ctx context.Context, tx *sql.Tx, who auditor, a album, versions []int64, anyVersion bool, get albumValues, genres, tags []string, cover *coverImages) (current, updated album, err error) {
+	id := a.ID
+	current, err = lockAlbum(tx, id)
+	if err == sql.ErrNoRows {
+		return current, updated, errAlbumNotFound
+	}
+	if err != nil {
+		return current, updated, err
+	}
+
+	// Fields the request left out keep their stored values. Filling them in
+	// before the version check lets a conflict card resubmit all of them.
+	a.release = current.release
+	if err = bindRelease(get, &a.release); err != nil {
+		return current, updated, invalidAlbum{err}
+	}
+	a.Genres, a.Tags = current.Genres, current.Tags
+	if genres != nil {
+		a.Genres = genres
+	}
+	if tags != nil {
+		a.Tags = tags
+	}
+	a.Cover = current.Cover
+	if v, _ := get("remove_cover"); v != "" {
+		a.Cover = ""
+	}
+	if !versionMatches(versions, anyVersion, current.Version) {
+		return current, updated, albumConflict{current: current, mine: &a}
 	}
 
-	// Get the updated album to return
-	a.ID = id
-	render(c, 200, Album(a))
+	art, err := resolveArtist(tx, a.Artist)
+	if err != nil {
+		return current, updated, err
+	}
+	// The labels go in first so that RETURNING reads the new ones.
+	if genres != nil {
+		if err = setAlbumTerms(tx, genreTerms, id, genres); err != nil {
+			return current, updated, err
+		}
+	}
+	if tags != nil {
+		if err = setAlbumTerms(tx, tagTerms, id, tags); err != nil {
+			return current, updated, err
+		}
+	}
+	if cover != nil {
+		if a.Cover, err = saveCover(ctx, cover); err != nil {
+			return current, updated, err
+		}
+	}
+	updateSQL := `
+        UPDATE albums
+        SET title = $1, artist = $2, artist_id = $3, price = $4,
+            release_year = NULLIF($5, 0), label = $6, format = $7, catalog_number = $8, barcode = $9,
+            cover_key = $10, updated_at = now(), version = version + 1
+        WHERE id = $11
+        RETURNING ` + albumColumns + `;
+	`
+	r := a.release
+	updated, err = scanAlbum(tx.QueryRow(updateSQL, a.Title, art.Name, art.ID, a.Price,
+		r.Year, r.Label, r.Format, r.CatalogNumber, r.Barcode, a.Cover, id))
+	if err != nil {
+		return current, updated, err
+	}
+	err = who.record(tx, "update", &current, &updated)
+	return current, updated, err
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// albumsChannel is the Postgres channel the albums trigger notifies of
+// each change it records in album_changes.
+const albumsChannel = "albums"
+
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+
+	// listenerPing is how often an idle listener checks its connection is
+	// still alive, so a dead one is noticed and replaced.
+	listenerPing = 90 * time.Second
+)
+
+// albumChange is a row of album_changes, which is also what a notification
+// carries.
+type albumChange struct {
+	ID      int64  `json:"id"`
+	Kind    string `json:"kind"`
+	AlbumID string `json:"album_id"`
+}
+
+// listenForChanges relays album changes from every instance, this one
+// included, into the local event hub. Changes are committed before they
+// are notified, so a subscriber that fetches the album sees the change.
+// When the connection drops, pq reconnects by itself; once it is back,
+// the changes missed in between are read from album_changes, unless they
+// have been pruned by then. It runs for the life of the process.
+func listenForChanges(connInfo string) {
+	last, err := lastAlbumChange()
+	if err != nil {
+		log.Printf("Failed to read the latest album change: %v", err)
+	}
+
+	listener := pq.NewListener(connInfo, listenerMinReconnect, listenerMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Lost the album change listener: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("Album change listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Album change listener failed to reconnect: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err = listener.Listen(albumsChannel); err != nil {
+		log.Printf("Failed to listen for album changes: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			// pq sends nil after reconnecting; notifications sent while it
+			// was away are lost.
+			if n == nil {
+				if last, err = backfillAlbumChanges(last); err != nil {
+					log.Printf("Failed to backfill album changes: %v", err)
+				}
+				continue
+			}
+			var ch albumChange
+			if err := json.Unmarshal([]byte(n.Extra), &ch); err != nil {
+				log.Printf("Bad album change notification %q: %v", n.Extra, err)
+				continue
+			}
+			publishAlbumChange(ch)
+			last = max(last, ch.ID)
+		case <-time.After(listenerPing):
+			if err := listener.Ping(); err != nil {
+				log.Printf("Album change listener ping failed: %v", err)
+			}
+		}
+	}
+}
+
+func publishAlbumChange(ch albumChange) {
+	albumEvents.Publish(albumEvent{Kind: ch.Kind, AlbumID: ch.AlbumID})
+}
+
+func lastAlbumChange() (int64, error) {
+	var last int64
+	err := db.QueryRow("SELECT COALESCE(max(id), 0) FROM album_changes").Scan(&last)
+	return last, err
+}
+
+// backfillAlbumChanges publishes the changes recorded after last and
+// returns the new last one.
+func backfillAlbumChanges(last int64) (int64, error) {
+	rows, err := db.Query("SELECT id, kind, album_id FROM album_changes WHERE id > $1 ORDER BY id", last)
+	if err != nil {
+		return last, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ch albumChange
+		if err := rows.Scan(&ch.ID, &ch.Kind, &ch.AlbumID); err != nil {
+			return last, err
+		}
+		publishAlbumChange(ch)
+		last = ch.ID
+	}
+	return last, rows.Err()
+}
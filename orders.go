@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// orderTransitions lists the statuses an order may move to from each
+// status. Shipped and cancelled orders are final.
+var orderTransitions = map[string][]string{
+	"pending": {"paid", "cancelled"},
+	"paid":    {"shipped", "cancelled"},
+}
+
+type orderItem struct {
+	// AlbumID is empty once the album has been purged; the title, artist
+	// and price are copies taken at checkout.
+	AlbumID   string  `json:"album_id"`
+	Title     string  `json:"title"`
+	Artist    string  `json:"artist"`
+	UnitPrice float64 `json:"unit_price"`
+	Quantity  int     `json:"quantity"`
+	// Discount is what promotions took off the line.
+	Discount float64 `json:"discount"`
+}
+
+func (i orderItem) Subtotal() float64 {
+	return i.UnitPrice * float64(i.Quantity)
+}
+
+// Total is the line after its discount.
+func (i orderItem) Total() float64 {
+	return i.Subtotal() - i.Discount
+}
+
+type order struct {
+	ID           string  `json:"id"`
+	Status       string  `json:"status"`
+	CustomerName string  `json:"customer_name"`
+	Email        string  `json:"email"`
+	Total        float64 `json:"total"`
+	// Discount is everything promotions took off, the lines' discounts
+	// included; Total is after it.
+	Discount    float64     `json:"discount"`
+	Items       []orderItem `json:"items"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	PaidAt      *time.Time  `json:"paid_at,omitempty"`
+	ShippedAt   *time.Time  `json:"shipped_at,omitempty"`
+	CancelledAt *time.Time  `json:"cancelled_at,omitempty"`
+	Payments    []payment   `json:"payments,omitempty"`
+
+	session string
+}
+
+// NextStatuses are the statuses the order can move to.
+func (o order) NextStatuses() []string {
+	return orderTransitions[o.Status]
+}
+
+// Settling reports whether a payment for the order is under way, in which
+// case it can neither be paid again nor cancelled until that finishes.
+func (o order) Settling() bool {
+	return slices.ContainsFunc(o.Payments, func(p payment) bool {
+		return p.Status == "pending" || p.Status == "authorized"
+	})
+}
+
+// AmountCents is the order total in the unit payment providers use.
+func (o order) AmountCents() int64 {
+	return int64(math.Round(o.Total * 100))
+}
+
+const orderColumns = "id, status, customer_name, email, total, discount, created_at, updated_at, paid_at, shipped_at, cancelled_at, session_id"
+
+func scanOrder(row scanner) (order, error) {
+	var o order
+	err := row.Scan(&o.ID, &o.Status, &o.CustomerName, &o.Email, &o.Total, &o.Discount, &o.CreatedAt, &o.UpdatedAt,
+		&o.PaidAt, &o.ShippedAt, &o.CancelledAt, &o.session)
+	return o, err
+}
+
+func queryOrders(q querier, query string, args ...any) ([]order, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func queryOrderItems(q querier, orderID string) ([]orderItem, error) {
+	rows, err := q.Query(`
+        SELECT COALESCE(album_id::text, ''), title, artist, unit_price, quantity, discount
+        FROM order_items WHERE order_id = $1 ORDER BY line`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []orderItem
+	for rows.Next() {
+		var i orderItem
+		if err := rows.Scan(&i.AlbumID, &i.Title, &i.Artist, &i.UnitPrice, &i.Quantity, &i.Discount); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	return items, rows.Err()
+}
+
+// isStaff reports whether the request came through the authenticating
+// proxy, which is the only way to act on other customers' orders. The
+// header only survives forwardedUser if it did.
+func isStaff(c *gin.Context) bool {
+	return c.GetHeader("X-Forwarded-User") != ""
+}
+
+// fetchOrder reads an order with its items and payments. Customers only
+// see their own orders; anyone else's are reported as not found.
+func fetchOrder(c *gin.Context, q querier, id string, lock bool) (order, error) {
+	o, err := loadOrder(q, id, lock)
+	if err != nil {
+		return o, err
+	}
+	if !isStaff(c) && o.session != sessionID(c, false) {
+		return order{}, sql.ErrNoRows
+	}
+	return o, nil
+}
+
+// loadOrder reads an order for the server's own use, whoever it belongs
+// to. With lock set it holds the order's row lock until q's transaction
+// ends; anything that changes an order or its payments takes that lock
+// first.
+func loadOrder(q querier, id string, lock bool) (order, error) {
+	query := "SELECT " + orderColumns + " FROM orders WHERE id = $1"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	o, err := scanOrder(q.QueryRow(query, id))
+	if err != nil {
+		return o, err
+	}
+	if o.Items, err = queryOrderItems(q, id); err != nil {
+		return o, err
+	}
+	o.Payments, err = queryPayments(q, "SELECT "+paymentColumns+" FROM payments WHERE order_id = $1 ORDER BY id", id)
+	return o, err
+}
+
+// checkout turns the session's cart into a pending order. The albums are
+// locked in id order, so concurrent checkouts of the same albums queue up
+// rather than deadlock, and each line takes its copies out of stock;
+// checkout fails as a whole if any album is short. The cart is priced
+// again inside the transaction, so the order gets the promotions in force
+// as it is placed, and uses them up.
+func checkout(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("customer_name"))
+	email := strings.TrimSpace(c.PostForm("email"))
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "customer_name is required"})
+		return
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	session := sessionID(c, false)
+	if session == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the cart is empty"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+        SELECT 1 FROM albums WHERE id IN (SELECT album_id FROM cart_items WHERE session_id = $1)
+        ORDER BY id FOR UPDATE`, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ct, err := loadCart(tx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(ct.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the cart is empty"})
+		return
+	}
+	code, err := cartCode(tx, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	promotions, err := currentPromotions(tx, code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	pr := evaluatePromotions(ct.Items, promotions, code)
+
+	var orderID string
+	err = tx.QueryRow(`
+        INSERT INTO orders (session_id, customer_name, email, total, discount)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id`, session, name, email, pr.Total, pr.Discount).Scan(&orderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for line, item := range pr.Lines {
+		a := item.Album
+		_, err = adjustStock(tx, c, a.ID, -item.Quantity, "reserved", "Order #"+orderID)
+		if err == errInsufficientStock {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("only %d of %s in stock", a.Stock, a.Title)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = tx.Exec(`
+            INSERT INTO order_items (order_id, line, album_id, title, artist, unit_price, quantity, discount)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, orderID, line+1, a.ID, a.Title, a.Artist, a.Price, item.Quantity, item.Discount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	err = redeemPromotions(tx, orderID, pr)
+	if errors.Is(err, errPromotionUsedUp) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err = tx.Exec("DELETE FROM cart_items WHERE session_id = $1", session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err = tx.Exec("DELETE FROM cart_codes WHERE session_id = $1", session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	url := "/orders/" + orderID
+	if c.GetHeader("HX-Request") == "true" {
+		c.Header("HX-Redirect", url)
+		c.Status(http.StatusCreated)
+		return
+	}
+	c.Header("Location", url)
+	o, err := fetchOrder(c, db, orderID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, o)
+}
+
+// getOrders is the customer's order history. Staff may pass ?all=1 to see
+// every customer's.
+func getOrders(c *gin.Context) {
+	all := c.Query("all") != "" && isStaff(c)
+	var orders []order
+	var err error
+	switch {
+	case all:
+		orders, err = queryOrders(db, "SELECT "+orderColumns+" FROM orders ORDER BY id DESC")
+	case sessionID(c, false) != "":
+		orders, err = queryOrders(db, "SELECT "+orderColumns+" FROM orders WHERE session_id = $1 ORDER BY id DESC", sessionID(c, false))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range orders {
+		if orders[i].Items, err = queryOrderItems(db, orders[i].ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if responseVariant(c) == "json" {
+		c.JSON(http.StatusOK, orders)
+		return
+	}
+	render(c, 200, OrdersPage(orders, all))
+}
+
+func getOrderByID(c *gin.Context) {
+	o, err := fetchOrder(c, db, c.Param("orderID"), false)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, OrderDetail(o, isStaff(c)))
+	case "json":
+		c.JSON(http.StatusOK, o)
+	default:
+		render(c, 200, OrderPage(o, isStaff(c)))
+	}
+}
+
+// updateOrderStatus moves an order along its lifecycle. Customers may only
+// cancel their own pending orders; everything else is for staff.
+// Cancelling puts the copies back in stock.
+func updateOrderStatus(c *gin.Context) {
+	status := c.PostForm("status")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	o, err := fetchOrder(c, tx, c.Param("orderID"), true)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !slices.Contains(o.NextStatuses(), status) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a %s order cannot be %s", o.Status, status)})
+		return
+	}
+	if !isStaff(c) && !(o.Status == "pending" && status == "cancelled") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can mark an order " + status})
+		return
+	}
+	if status == "cancelled" {
+		if o.Settling() {
+			c.JSON(http.StatusConflict, gin.H{"error": "a payment for this order is still being settled"})
+			return
+		}
+		if err = refundOrder(c, tx, o); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err = setOrderStatus(tx, c, o, status); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	o, err = fetchOrder(c, db, o.ID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, OrderDetail(o, isStaff(c)))
+		return
+	}
+	c.JSON(http.StatusOK, o)
+}
+
+// setOrderStatus records a transition the caller has already checked, in
+// tx, and returns the stock and promotion uses of a cancelled order. c is
+// nil for changes the server makes on its own.
+func setOrderStatus(tx *sql.Tx, c *gin.Context, o order, status string) error {
+	_, err := tx.Exec(`
+        UPDATE orders SET status = $1, updated_at = now(),
+            paid_at = CASE WHEN $1::text = 'paid' THEN now() ELSE paid_at END,
+            shipped_at = CASE WHEN $1::text = 'shipped' THEN now() ELSE shipped_at END,
+            cancelled_at = CASE WHEN $1::text = 'cancelled' THEN now() ELSE cancelled_at END
+        WHERE id = $2`, status, o.ID)
+	if err != nil || status != "cancelled" {
+		return err
+	}
+	if err = releasePromotions(tx, o.ID); err != nil {
+		return err
+	}
+	for _, item := range o.Items {
+		if item.AlbumID == "" {
+			continue
+		}
+		_, err := adjustStock(tx, c, item.AlbumID, item.Quantity, "released", "Order #"+o.ID+" cancelled")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
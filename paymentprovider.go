@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// paymentProvider takes payments for orders. Amounts are in cents.
+// Authorize, Capture and Refund must be safe to repeat with the same
+// idempotency key: a retried call returns the first call's result rather
+// than charging twice.
+type paymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, req paymentRequest) (paymentResult, error)
+	Capture(ctx context.Context, reference string, amount int64, idempotencyKey string) (paymentResult, error)
+	Refund(ctx context.Context, reference string, amount int64, idempotencyKey string) (paymentResult, error)
+	// VerifyWebhook checks a webhook's signature and decodes the event it
+	// carries.
+	VerifyWebhook(header http.Header, body []byte) (paymentEvent, error)
+}
+
+type paymentRequest struct {
+	OrderID        string
+	Amount         int64
+	Currency       string
+	Token          string
+	IdempotencyKey string
+}
+
+// paymentResult is the provider's view of a payment after a call. Status is
+// one of the payment statuses: a settlement the provider finishes later is
+// "pending" until a webhook says otherwise.
+type paymentResult struct {
+	Reference     string
+	Status        string
+	DeclineReason string
+}
+
+// paymentEvent is a status change the provider reports by webhook. ID is
+// unique per event, so redelivered webhooks can be recognised.
+type paymentEvent struct {
+	ID        string `json:"id"`
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+var errBadSignature = errors.New("invalid webhook signature")
+
+// webhookTolerance is how old a signed webhook may be, limiting replays.
+const webhookTolerance = 5 * time.Minute
+
+var payments paymentProvider
+
+// newPaymentProvider picks the provider from PAYMENT_PROVIDER. Only the
+// built-in "fake" exists so far. It takes no real money, so it is never
+// picked by default and refuses to run with GO_ENV=production. Without a
+// provider it returns nil, and orders cannot be paid.
+func newPaymentProvider() (paymentProvider, error) {
+	switch kind := os.Getenv("PAYMENT_PROVIDER"); kind {
+	case "":
+		return nil, nil
+	case "fake":
+		if os.Getenv("GO_ENV") == "production" {
+			return nil, errors.New("the fake payment provider cannot be used in production")
+		}
+		// Anyone who knows the secret can settle payments.
+		secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, errors.New("PAYMENT_WEBHOOK_SECRET is required")
+		}
+		webhookURL := os.Getenv("PAYMENT_WEBHOOK_URL")
+		if webhookURL == "" {
+			webhookURL = "http://localhost:8080/payments/webhook"
+		}
+		delay := 5 * time.Second
+		if v := os.Getenv("FAKE_SETTLEMENT_DELAY"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FAKE_SETTLEMENT_DELAY: %w", err)
+			}
+			delay = d
+		}
+		return newFakeProvider(secret, webhookURL, delay), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", kind)
+	}
+}
+
+// signWebhook signs a webhook body as "t=<unix time>,v1=<hex HMAC>", the
+// HMAC-SHA256 of the time, a dot and the body under the shared secret.
+func signWebhook(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	mac := hmacSHA256([]byte(secret), t+"."+string(body))
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac)
+}
+
+// verifyWebhookSignature checks a header made by signWebhook, rejecting
+// ones older than webhookTolerance.
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time) error {
+	var t, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || sig == "" {
+		return errBadSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return errBadSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, hmacSHA256([]byte(secret), t+"."+string(body))) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// fakeTokens are the card tokens the fake provider understands, with what
+// each one simulates.
+var fakeTokens = []struct{ Token, Label string }{
+	{"tok_success", "Payment succeeds"},
+	{"tok_decline", "Card is declined"},
+	{"tok_delayed", "Settles later by webhook"},
+}
+
+// fakeProvider simulates a payment service in memory, for development and
+// tests. Results are remembered by idempotency key for the life of the
+// process.
+type fakeProvider struct {
+	secret     string
+	webhookURL string
+	delay      time.Duration
+	client     *http.Client
+
+	mu       sync.Mutex
+	results  map[string]paymentResult // by idempotency key
+	payments map[string]*fakePayment  // by reference
+	events   int
+}
+
+type fakePayment struct {
+	amount   int64
+	status   string
+	refunded int64
+}
+
+func newFakeProvider(secret, webhookURL string, delay time.Duration) *fakeProvider {
+	return &fakeProvider{
+		secret:     secret,
+		webhookURL: webhookURL,
+		delay:      delay,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		results:    map[string]paymentResult{},
+		payments:   map[string]*fakePayment{},
+	}
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) Authorize(_ context.Context, req paymentRequest) (paymentResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.results[req.IdempotencyKey]; ok {
+		return r, nil
+	}
+
+	r := paymentResult{Reference: "fake_" + newPaymentKey()}
+	switch req.Token {
+	case "tok_success":
+		r.Status = "authorized"
+	case "tok_decline":
+		r.Status, r.DeclineReason = "declined", "card_declined"
+	case "tok_delayed":
+		r.Status = "pending"
+		go p.settleLater(r.Reference)
+	default:
+		r.Status, r.DeclineReason = "declined", "invalid_token"
+	}
+	p.payments[r.Reference] = &fakePayment{amount: req.Amount, status: r.Status}
+	p.results[req.IdempotencyKey] = r
+	return r, nil
+}
+
+func (p *fakeProvider) Capture(_ context.Context, reference string, amount int64, idempotencyKey string) (paymentResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.results[idempotencyKey]; ok {
+		return r, nil
+	}
+	fp, ok := p.payments[reference]
+	if !ok {
+		return paymentResult{}, fmt.Errorf("no payment %s", reference)
+	}
+	if fp.status != "authorized" || amount > fp.amount {
+		return paymentResult{}, fmt.Errorf("cannot capture %d from %s payment %s", amount, fp.status, reference)
+	}
+	fp.status = "captured"
+	r := paymentResult{Reference: reference, Status: "captured"}
+	p.results[idempotencyKey] = r
+	return r, nil
+}
+
+func (p *fakeProvider) Refund(_ context.Context, reference string, amount int64, idempotencyKey string) (paymentResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.results[idempotencyKey]; ok {
+		return r, nil
+	}
+	fp, ok := p.payments[reference]
+	if !ok {
+		return paymentResult{}, fmt.Errorf("no payment %s", reference)
+	}
+	if fp.status != "captured" || fp.refunded+amount > fp.amount {
+		return paymentResult{}, fmt.Errorf("cannot refund %d from %s payment %s", amount, fp.status, reference)
+	}
+	fp.refunded += amount
+	if fp.refunded == fp.amount {
+		fp.status = "refunded"
+	}
+	r := paymentResult{Reference: reference, Status: fp.status}
+	p.results[idempotencyKey] = r
+	return r, nil
+}
+
+func (p *fakeProvider) VerifyWebhook(header http.Header, body []byte) (paymentEvent, error) {
+	var e paymentEvent
+	if err := verifyWebhookSignature(p.secret, header.Get("X-Payment-Signature"), body, time.Now()); err != nil {
+		return e, err
+	}
+	err := json.Unmarshal(body, &e)
+	return e, err
+}
+
+// settleLater captures a delayed payment after the configured delay and
+// tells the app so with a signed webhook, as a real provider would.
+func (p *fakeProvider) settleLater(reference string) {
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	fp := p.payments[reference]
+	fp.status = "captured"
+	p.events++
+	event := paymentEvent{ID: fmt.Sprintf("evt_fake_%d", p.events), Reference: reference, Status: "captured"}
+	p.mu.Unlock()
+
+	body, _ := json.Marshal(event)
+	// The app may not have recorded the payment yet, so retry a few times.
+	for attempt := 1; attempt <= 3; attempt++ {
+		err := p.sendWebhook(body)
+		if err == nil {
+			return
+		}
+		log.Printf("Fake payment webhook for %s, attempt %d: %v", reference, attempt, err)
+		time.Sleep(time.Duration(attempt) * p.delay)
+	}
+}
+
+func (p *fakeProvider) sendWebhook(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Payment-Signature", signWebhook(p.secret, time.Now(), body))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// paymentTransitions lists the statuses a payment may move to from each
+// status. Events that would move it any other way arrive out of order and
+// are ignored.
+var paymentTransitions = map[string][]string{
+	"pending":    {"authorized", "captured", "declined"},
+	"authorized": {"captured", "declined"},
+	"captured":   {"refunded"},
+}
+
+// maxWebhookBody caps what a payment webhook may send.
+const maxWebhookBody = 1 << 20
+
+type payment struct {
+	ID            string    `json:"id"`
+	OrderID       string    `json:"order_id"`
+	Provider      string    `json:"provider"`
+	Reference     string    `json:"reference,omitempty"`
+	Status        string    `json:"status"`
+	Amount        float64   `json:"amount"`
+	DeclineReason string    `json:"decline_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+const paymentColumns = "id, order_id, provider, reference, status, amount, decline_reason, created_at, updated_at"
+
+func scanPayment(row scanner) (payment, error) {
+	var p payment
+	err := row.Scan(&p.ID, &p.OrderID, &p.Provider, &p.Reference, &p.Status, &p.Amount, &p.DeclineReason, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func queryPayments(q querier, query string, args ...any) ([]payment, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []payment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// newPaymentKey makes an idempotency key for the payment form, so a
+// resubmitted form does not pay twice.
+func newPaymentKey() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// postPayment pays for an order with a card token. The Idempotency-Key
+// header, or the payment_key field the order page submits, names the
+// attempt: repeating it returns the first attempt's payment, and an
+// attempt cut short by a provider error resumes where it stopped.
+//
+// The payment is recorded as pending before the provider is called, so a
+// charge the provider makes can always be matched to a row here. If the
+// provider fails without taking it on, the payment is marked failed so the
+// order can be paid another way or cancelled.
+func postPayment(c *gin.Context) {
+	if payments == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "payments are not set up"})
+		return
+	}
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = c.PostForm("payment_key")
+	}
+	if key == "" || len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is required"})
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	o, err := fetchOrder(c, tx, c.Param("orderID"), true)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	p, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE idempotency_key = $1", key))
+	created := err == sql.ErrNoRows
+	switch {
+	case created:
+		if o.Status != "pending" {
+			c.JSON(http.StatusConflict, gin.H{"error": "the order is already " + o.Status})
+			return
+		}
+		if o.Settling() {
+			c.JSON(http.StatusConflict, gin.H{"error": "a payment for this order is still being settled"})
+			return
+		}
+		p, err = scanPayment(tx.QueryRow(`
+            INSERT INTO payments (order_id, provider, idempotency_key, status, amount)
+            VALUES ($1, $2, $3, 'pending', $4)
+            RETURNING `+paymentColumns, o.ID, payments.Name(), key, o.Total))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	case p.OrderID != o.ID:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for another order"})
+		return
+	case p.Status == "failed":
+		// The provider could not be reached last time; try again, unless
+		// another attempt has got further since.
+		if o.Status != "pending" {
+			c.JSON(http.StatusConflict, gin.H{"error": "the order is already " + o.Status})
+			return
+		}
+		if o.Settling() {
+			c.JSON(http.StatusConflict, gin.H{"error": "a payment for this order is still being settled"})
+			return
+		}
+		p, err = scanPayment(tx.QueryRow(`
+            UPDATE payments SET status = 'pending', decline_reason = '', updated_at = now()
+            WHERE id = $1
+            RETURNING `+paymentColumns, p.ID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	case p.Reference != "" && p.Status != "authorized":
+		// Already answered by the provider: replay it.
+		tx.Rollback()
+		paymentResponse(c, http.StatusOK, p)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	r, err := payments.Authorize(ctx, paymentRequest{
+		OrderID:        o.ID,
+		Amount:         o.AmountCents(),
+		Currency:       "USD",
+		Token:          token,
+		IdempotencyKey: key,
+	})
+	if err == nil && r.Status == "authorized" {
+		var captured paymentResult
+		captured, err = payments.Capture(ctx, r.Reference, o.AmountCents(), key+":capture")
+		if err == nil {
+			r = captured
+		}
+	}
+	if err != nil && r.Reference == "" {
+		// Nothing to match a later webhook to, so the attempt would stay
+		// pending and block the order for good.
+		if _, ferr := db.Exec(`
+            UPDATE payments SET status = 'failed', decline_reason = $1, updated_at = now()
+            WHERE id = $2 AND status = 'pending' AND reference = ''`, err.Error(), p.ID); ferr != nil {
+			log.Printf("Marking payment %s failed: %v", p.ID, ferr)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "payment provider: " + err.Error()})
+		return
+	}
+	if err != nil {
+		// Authorized but not captured; retrying the same key captures it.
+		log.Printf("Capturing payment %s: %v", p.ID, err)
+	}
+
+	p, err = recordPaymentResult(c, o.ID, p.ID, r)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	paymentResponse(c, status, p)
+}
+
+// recordPaymentResult stores what the provider said about a payment in its
+// own transaction, taking the order's lock before the payment's.
+func recordPaymentResult(c *gin.Context, orderID, paymentID string, r paymentResult) (payment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return payment{}, err
+	}
+	defer tx.Rollback()
+
+	o, err := loadOrder(tx, orderID, true)
+	if err != nil {
+		return payment{}, err
+	}
+	p, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1 FOR UPDATE", paymentID))
+	if err != nil {
+		return payment{}, err
+	}
+	if p, err = applyPaymentResult(tx, c, o, p, r); err != nil {
+		return payment{}, err
+	}
+	return p, tx.Commit()
+}
+
+// applyPaymentResult moves a payment to the status r reports, in tx, and
+// marks a pending order paid once its payment is captured. The caller
+// holds the locks on o and p. Results that do not follow from p's status
+// are stale and leave it alone. c is nil for changes the server makes on
+// its own, such as webhooks.
+func applyPaymentResult(tx *sql.Tx, c *gin.Context, o order, p payment, r paymentResult) (payment, error) {
+	if r.Status != p.Status && !slices.Contains(paymentTransitions[p.Status], r.Status) {
+		return p, nil
+	}
+	if r.Reference == "" {
+		r.Reference = p.Reference
+	}
+	updated, err := scanPayment(tx.QueryRow(`
+        UPDATE payments SET reference = $1, status = $2, decline_reason = $3, updated_at = now()
+        WHERE id = $4
+        RETURNING `+paymentColumns, r.Reference, r.Status, r.DeclineReason, p.ID))
+	if err != nil || updated.Status != "captured" || p.Status == "captured" {
+		return updated, err
+	}
+	if o.Status != "pending" {
+		log.Printf("Payment %s captured for %s order %s", p.ID, o.Status, o.ID)
+		return updated, nil
+	}
+	return updated, setOrderStatus(tx, c, o, "paid")
+}
+
+// refundOrder refunds the captured payments of an order being cancelled,
+// in tx, which holds the order's lock. The refund is keyed by payment, so
+// retrying a cancellation that failed after the provider refunded does not
+// refund twice.
+func refundOrder(c *gin.Context, tx *sql.Tx, o order) error {
+	for _, p := range o.Payments {
+		if p.Status != "captured" {
+			continue
+		}
+		if payments == nil || p.Provider != payments.Name() {
+			return fmt.Errorf("payment %s was taken by %s", p.ID, p.Provider)
+		}
+		r, err := payments.Refund(c.Request.Context(), p.Reference, o.AmountCents(), "refund:"+p.ID)
+		if err != nil {
+			return fmt.Errorf("refunding payment %s: %w", p.ID, err)
+		}
+		locked, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE id = $1 FOR UPDATE", p.ID))
+		if err != nil {
+			return err
+		}
+		if _, err = applyPaymentResult(tx, c, o, locked, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func paymentResponse(c *gin.Context, status int, p payment) {
+	if c.GetHeader("HX-Request") == "true" {
+		o, err := fetchOrder(c, db, p.OrderID, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		render(c, 200, OrderDetail(o, isStaff(c)))
+		return
+	}
+	if p.Status == "declined" {
+		status = http.StatusPaymentRequired
+	}
+	c.JSON(status, p)
+}
+
+// paymentWebhook takes status changes from the payment provider. Each event
+// is handled once: its ID is recorded in the same transaction as its
+// effect, and a redelivery is acknowledged without doing anything. Events
+// for payments we have not recorded a reference for yet fail, so the
+// provider retries them.
+func paymentWebhook(c *gin.Context) {
+	if payments == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "payments are not set up"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBody))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	e, err := payments.VerifyWebhook(c.Request.Header, body)
+	if errors.Is(err, errBadSignature) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil || e.ID == "" || e.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+        INSERT INTO payment_webhook_events (provider, event_id, reference, status)
+        VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, payments.Name(), e.ID, e.Reference, e.Status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+
+	var orderID string
+	err = tx.QueryRow("SELECT order_id FROM payments WHERE provider = $1 AND reference = $2", payments.Name(), e.Reference).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	o, err := loadOrder(tx, orderID, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := scanPayment(tx.QueryRow("SELECT "+paymentColumns+" FROM payments WHERE provider = $1 AND reference = $2 FOR UPDATE", payments.Name(), e.Reference))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err = applyPaymentResult(tx, nil, o, p, paymentResult{Reference: e.Reference, Status: e.Status, DeclineReason: e.Reason}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
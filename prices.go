@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// priceScheduleInterval is how often due price changes are applied, and so
+// roughly how late one can be.
+const priceScheduleInterval = time.Minute
+
+// pricePoint is one entry of an album's price history.
+type pricePoint struct {
+	Price     float64   `json:"price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// priceSchedule is a price change set for later. A "change" sets the price
+// for good when it starts; a "sale" sets it until ends_at and then puts
+// back the price it replaced.
+type priceSchedule struct {
+	ID            string     `json:"id"`
+	AlbumID       string     `json:"album_id"`
+	Kind          string     `json:"kind"`
+	Price         float64    `json:"price"`
+	StartsAt      time.Time  `json:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at,omitempty"`
+	Status        string     `json:"status"`
+	OriginalPrice *float64   `json:"original_price,omitempty"`
+	Actor         string     `json:"actor"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+const priceScheduleColumns = "id, album_id, kind, price, starts_at, ends_at, status, original_price, actor, created_at"
+
+func scanPriceSchedule(row scanner) (priceSchedule, error) {
+	var s priceSchedule
+	err := row.Scan(&s.ID, &s.AlbumID, &s.Kind, &s.Price, &s.StartsAt, &s.EndsAt, &s.Status, &s.OriginalPrice, &s.Actor, &s.CreatedAt)
+	return s, err
+}
+
+func queryPriceSchedules(q querier, query string, args ...any) ([]priceSchedule, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []priceSchedule
+	for rows.Next() {
+		s, err := scanPriceSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+func queryPriceHistory(albumID string) ([]pricePoint, error) {
+	rows, err := db.Query("SELECT price, changed_at FROM price_history WHERE album_id = $1 ORDER BY changed_at, id", albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []pricePoint
+	for rows.Next() {
+		var p pricePoint
+		if err := rows.Scan(&p.Price, &p.ChangedAt); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// sparkline lays out a price history as an SVG polyline of the given size.
+// Prices hold until the next change, so it steps rather than slopes, and
+// the last price runs on to now.
+func sparkline(points []pricePoint, now time.Time, width, height float64) string {
+	if len(points) == 0 {
+		return ""
+	}
+	start := points[0].ChangedAt
+	span := now.Sub(start).Seconds()
+	lo, hi := points[0].Price, points[0].Price
+	for _, p := range points {
+		lo, hi = math.Min(lo, p.Price), math.Max(hi, p.Price)
+	}
+	scale := 0.0
+	if span > 0 {
+		scale = width / span
+	}
+	x := func(t time.Time) float64 {
+		return t.Sub(start).Seconds() * scale
+	}
+	// Leave a pixel at the edges so the stroke is not clipped.
+	y := func(price float64) float64 {
+		if hi == lo {
+			return height / 2
+		}
+		return 1 + (hi-price)/(hi-lo)*(height-2)
+	}
+
+	var b strings.Builder
+	for i, p := range points {
+		px, py := x(p.ChangedAt), y(p.Price)
+		if i > 0 {
+			fmt.Fprintf(&b, " %.1f,%.1f", px, y(points[i-1].Price))
+		}
+		fmt.Fprintf(&b, " %.1f,%.1f", px, py)
+	}
+	fmt.Fprintf(&b, " %.1f,%.1f", width, y(points[len(points)-1].Price))
+	return strings.TrimSpace(b.String())
+}
+
+// parseScheduleTime reads a time from a datetime-local input, in the
+// user's time zone, or an RFC 3339 time from API clients.
+func parseScheduleTime(c *gin.Context, v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04", v, userLocation(c.Request.Context()))
+}
+
+func getPrices(c *gin.Context) {
+	id := c.Param("id")
+	a, err := fetchAlbum(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	history, err := queryPriceHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	schedules, err := queryPriceSchedules(db, "SELECT "+priceScheduleColumns+" FROM price_schedules WHERE album_id = $1 AND status IN ('scheduled', 'active') ORDER BY starts_at", id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, PricePanel(a, history, schedules))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"history": history, "schedules": schedules})
+}
+
+// postPriceSchedule schedules a price change or a sale. Sales on the same
+// album may not overlap, since each one puts back the price it found.
+func postPriceSchedule(c *gin.Context) {
+	id := c.Param("id")
+	s := priceSchedule{AlbumID: id, Kind: c.PostForm("kind"), Actor: auditActor(c)}
+	if s.Kind != "change" && s.Kind != "sale" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be change or sale"})
+		return
+	}
+	var err error
+	s.Price, err = strconv.ParseFloat(c.PostForm("price"), 64)
+	if err != nil || s.Price < 0 || math.IsInf(s.Price, 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+		return
+	}
+	s.StartsAt, err = parseScheduleTime(c, c.PostForm("starts_at"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid starts_at"})
+		return
+	}
+	if s.StartsAt.Before(time.Now().Add(-priceScheduleInterval)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "starts_at is in the past"})
+		return
+	}
+	if s.Kind == "sale" {
+		end, err := parseScheduleTime(c, c.PostForm("ends_at"))
+		if err != nil || !end.After(s.StartsAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a sale needs an ends_at after starts_at"})
+			return
+		}
+		s.EndsAt = &end
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = lockAlbum(tx, id); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.Kind == "sale" {
+		var overlaps bool
+		err = tx.QueryRow(`
+            SELECT EXISTS (SELECT 1 FROM price_schedules
+            WHERE album_id = $1 AND kind = 'sale' AND status IN ('scheduled', 'active')
+            AND starts_at < $3 AND ends_at > $2)`, id, s.StartsAt, *s.EndsAt).Scan(&overlaps)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if overlaps {
+			c.JSON(http.StatusConflict, gin.H{"error": "another sale overlaps that time"})
+			return
+		}
+	}
+	s, err = scanPriceSchedule(tx.QueryRow(`
+        INSERT INTO price_schedules (album_id, kind, price, starts_at, ends_at, actor)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING `+priceScheduleColumns, id, s.Kind, s.Price, s.StartsAt, s.EndsAt, s.Actor))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		getPrices(c)
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// deletePriceSchedule cancels a scheduled change. Cancelling a sale that
+// has started ends it now.
+func deletePriceSchedule(c *gin.Context) {
+	id := c.Param("id")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	s, err := scanPriceSchedule(tx.QueryRow(`
+        SELECT `+priceScheduleColumns+` FROM price_schedules
+        WHERE id = $1 AND album_id = $2 AND status IN ('scheduled', 'active') FOR UPDATE`, c.Param("scheduleID"), id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "scheduled price not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.Status == "active" {
+		err = endSale(tx, c, s)
+	} else {
+		_, err = tx.Exec("UPDATE price_schedules SET status = 'cancelled' WHERE id = $1", s.ID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		getPrices(c)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// setAlbumPrice changes an album's price in tx on behalf of a schedule and
+// audits it like an edit. It returns sql.ErrNoRows for a trashed album.
+func setAlbumPrice(tx *sql.Tx, c *gin.Context, albumID string, price float64) (album, error) {
+	current, err := lockAlbum(tx, albumID)
+	if err != nil {
+		return album{}, err
+	}
+	updated, err := scanAlbum(tx.QueryRow(`
+        UPDATE albums SET price = $1, updated_at = now(), version = version + 1
+        WHERE id = $2
+        RETURNING `+albumColumns, price, albumID))
+	if err != nil {
+		return album{}, err
+	}
+	return current, recordAudit(tx, c, "update", &current, &updated)
+}
+
+// startSchedule applies a due schedule, remembering what a sale replaces.
+func startSchedule(tx *sql.Tx, s priceSchedule) error {
+	current, err := setAlbumPrice(tx, nil, s.AlbumID, s.Price)
+	if err != nil {
+		return err
+	}
+	status := "done"
+	if s.Kind == "sale" {
+		status = "active"
+	}
+	_, err = tx.Exec("UPDATE price_schedules SET status = $1, original_price = $2 WHERE id = $3", status, current.Price, s.ID)
+	return err
+}
+
+// endSale puts back the price a sale replaced, unless someone has changed
+// the price by hand since it started, in which case theirs stands. It
+// returns sql.ErrNoRows for a trashed album.
+func endSale(tx *sql.Tx, c *gin.Context, s priceSchedule) error {
+	current, err := lockAlbum(tx, s.AlbumID)
+	if err != nil {
+		return err
+	}
+	if current.Price == s.Price && s.OriginalPrice != nil {
+		if _, err = setAlbumPrice(tx, c, s.AlbumID, *s.OriginalPrice); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE price_schedules SET status = 'done', ends_at = LEAST(ends_at, now()) WHERE id = $1", s.ID)
+	return err
+}
+
+// applyPriceSchedules starts and ends scheduled prices as they fall due.
+func applyPriceSchedules(ctx context.Context, _ struct{}) error {
+	n, err := applyDueSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Applied %d scheduled prices", n)
+	}
+	return nil
+}
+
+var applyPriceSchedulesJob = registerJob("apply_price_schedules", jobOptions{Every: priceScheduleInterval}, applyPriceSchedules)
+
+// applyDueSchedules handles each due schedule in its own transaction, so
+// one album failing does not hold up the rest. Sales that end are handled
+// before ones that start, in case one sale follows straight on from
+// another. Schedules for trashed albums wait until they are restored. It
+// stops between schedules once ctx is done, leaving the rest for next time.
+func applyDueSchedules(ctx context.Context) (int, error) {
+	due, err := queryPriceSchedules(db, `
+        SELECT `+priceScheduleColumns+` FROM price_schedules
+        WHERE (status = 'active' AND ends_at <= now()) OR (status = 'scheduled' AND starts_at <= now())
+        ORDER BY status = 'scheduled', starts_at`)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range due {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		err := applySchedule(ctx, s)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to apply scheduled price %s: %v", s.ID, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+func applySchedule(ctx context.Context, s priceSchedule) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Another instance, or a cancellation, may have got there first.
+	s, err = scanPriceSchedule(tx.QueryRow("SELECT "+priceScheduleColumns+" FROM price_schedules WHERE id = $1 AND status = $2 FOR UPDATE SKIP LOCKED", s.ID, s.Status))
+	if err != nil {
+		return err
+	}
+	if s.Status == "active" {
+		err = endSale(tx, nil, s)
+	} else {
+		err = startSchedule(tx, s)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
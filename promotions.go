@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// promotionKinds are the kinds of discount. Percent and fixed take Amount
+// off each qualifying copy, except that a fixed amount with no artist or
+// genre comes off the order as a whole. buy_x_get_y gives GetQuantity
+// copies of an album free for every BuyQuantity paid for.
+var promotionKinds = []string{"percent", "fixed", "buy_x_get_y"}
+
+// promotion is a discount that applies by itself or when its code is
+// entered at the cart.
+type promotion struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Code        string     `json:"code,omitempty"`
+	Kind        string     `json:"kind"`
+	Amount      float64    `json:"amount"`
+	ArtistID    string     `json:"artist_id,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Genre       string     `json:"genre,omitempty"`
+	BuyQuantity int        `json:"buy_quantity,omitempty"`
+	GetQuantity int        `json:"get_quantity,omitempty"`
+	MinTotal    float64    `json:"min_total"`
+	StartsAt    *time.Time `json:"starts_at,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	UsageLimit  *int       `json:"usage_limit,omitempty"`
+	TimesUsed   int        `json:"times_used"`
+	Active      bool       `json:"active"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+const promotionColumns = `promotions.id, promotions.name, promotions.code, promotions.kind, promotions.amount,
+    COALESCE(promotions.artist_id::text, ''), COALESCE(artists.name, ''), promotions.genre,
+    promotions.buy_quantity, promotions.get_quantity, promotions.min_total,
+    promotions.starts_at, promotions.ends_at, promotions.usage_limit, promotions.times_used,
+    promotions.active, promotions.updated_at
+    FROM promotions LEFT JOIN artists ON artists.id = promotions.artist_id`
+
+// promotionCurrent is true of promotions that can be used right now.
+const promotionCurrent = `promotions.active
+    AND (promotions.starts_at IS NULL OR promotions.starts_at <= now())
+    AND (promotions.ends_at IS NULL OR promotions.ends_at > now())
+    AND (promotions.usage_limit IS NULL OR promotions.times_used < promotions.usage_limit)`
+
+func scanPromotion(row scanner) (promotion, error) {
+	var p promotion
+	err := row.Scan(&p.ID, &p.Name, &p.Code, &p.Kind, &p.Amount, &p.ArtistID, &p.Artist, &p.Genre,
+		&p.BuyQuantity, &p.GetQuantity, &p.MinTotal, &p.StartsAt, &p.EndsAt, &p.UsageLimit, &p.TimesUsed,
+		&p.Active, &p.UpdatedAt)
+	return p, err
+}
+
+func queryPromotions(q querier, query string, args ...any) ([]promotion, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promotions []promotion
+	for rows.Next() {
+		p, err := scanPromotion(rows)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+// currentPromotions loads the promotions that apply by themselves, plus
+// the one with the given code if there is one.
+func currentPromotions(q querier, code string) ([]promotion, error) {
+	return queryPromotions(q, "SELECT "+promotionColumns+" WHERE "+promotionCurrent+`
+        AND (promotions.code = '' OR lower(promotions.code) = lower($1))
+        ORDER BY promotions.id`, code)
+}
+
+// Describe says what the promotion gives, for listings.
+func (p promotion) Describe() string {
+	var what string
+	switch p.Kind {
+	case "percent":
+		what = fmt.Sprintf("%g%% off", p.Amount)
+	case "fixed":
+		what = fmt.Sprintf("$%.2f off", p.Amount)
+		if p.ArtistID == "" && p.Genre == "" {
+			what += " the order"
+		} else {
+			what += " each"
+		}
+	case "buy_x_get_y":
+		what = fmt.Sprintf("buy %d get %d free", p.BuyQuantity, p.GetQuantity)
+	}
+	switch {
+	case p.Artist != "" && p.Genre != "":
+		what += " " + p.Genre + " by " + p.Artist
+	case p.Artist != "":
+		what += " albums by " + p.Artist
+	case p.Genre != "":
+		what += " " + p.Genre + " albums"
+	}
+	if p.MinTotal > 0 {
+		what += fmt.Sprintf(" on orders over $%.2f", p.MinTotal)
+	}
+	return what
+}
+
+// appliesTo reports whether an album is in the promotion's scope.
+func (p promotion) appliesTo(a album) bool {
+	if p.ArtistID != "" && p.ArtistID != a.ArtistID {
+		return false
+	}
+	if p.Genre == "" {
+		return true
+	}
+	for _, g := range a.Genres {
+		if strings.EqualFold(g, p.Genre) {
+			return true
+		}
+	}
+	return false
+}
+
+// orderLevel reports whether the promotion discounts the order rather
+// than its lines.
+func (p promotion) orderLevel() bool {
+	return p.Kind == "fixed" && p.ArtistID == "" && p.Genre == ""
+}
+
+// lineDiscount is what the promotion takes off a cart line.
+func (p promotion) lineDiscount(item cartItem) float64 {
+	if p.orderLevel() || !p.appliesTo(item.Album) {
+		return 0
+	}
+	price, n := item.Album.Price, float64(item.Quantity)
+	switch p.Kind {
+	case "percent":
+		return price * n * math.Min(p.Amount, 100) / 100
+	case "fixed":
+		return math.Min(p.Amount, price) * n
+	case "buy_x_get_y":
+		if p.BuyQuantity < 1 || p.GetQuantity < 1 {
+			return 0
+		}
+		free := item.Quantity / (p.BuyQuantity + p.GetQuantity) * p.GetQuantity
+		return price * float64(free)
+	}
+	return 0
+}
+
+func roundCents(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// pricedLine is a cart line with its discount.
+type pricedLine struct {
+	cartItem
+	Discount  float64    `json:"discount"`
+	Promotion *promotion `json:"promotion,omitempty"`
+}
+
+func (l pricedLine) Total() float64 {
+	return l.Subtotal() - l.Discount
+}
+
+// pricing is a cart priced by evaluatePromotions.
+type pricing struct {
+	Lines          []pricedLine `json:"lines"`
+	Subtotal       float64      `json:"subtotal"`
+	OrderDiscount  float64      `json:"order_discount"`
+	OrderPromotion *promotion   `json:"order_promotion,omitempty"`
+	Discount       float64      `json:"discount"`
+	Total          float64      `json:"total"`
+
+	// Code is the code entered at the cart, and CodeProblem why it is not
+	// taking effect, if it is not.
+	Code        string `json:"code,omitempty"`
+	CodeProblem string `json:"code_problem,omitempty"`
+}
+
+// Applied lists the promotions that gave a discount, each once.
+func (pr pricing) Applied() []promotion {
+	seen := map[string]bool{}
+	var applied []promotion
+	add := func(p *promotion) {
+		if p != nil && !seen[p.ID] {
+			seen[p.ID] = true
+			applied = append(applied, *p)
+		}
+	}
+	for _, l := range pr.Lines {
+		add(l.Promotion)
+	}
+	add(pr.OrderPromotion)
+	return applied
+}
+
+// Count is how many copies the cart holds.
+func (pr pricing) Count() int {
+	n := 0
+	for _, l := range pr.Lines {
+		n += l.Quantity
+	}
+	return n
+}
+
+// evaluatePromotions prices a cart. Discounts do not stack: each line gets
+// the best of the promotions that cover it, and the order the best
+// order-wide discount on top. A promotion counts only if the cart's total
+// before discounts reaches its minimum. code is the code the customer
+// entered, if any, so the result can say why it did not apply.
+func evaluatePromotions(items []cartItem, promotions []promotion, code string) pricing {
+	pr := pricing{Code: code}
+	for _, item := range items {
+		pr.Subtotal += item.Subtotal()
+	}
+
+	codeFound := false
+	var eligible []promotion
+	for _, p := range promotions {
+		if code != "" && strings.EqualFold(p.Code, code) {
+			codeFound = true
+			if pr.Subtotal < p.MinTotal {
+				pr.CodeProblem = fmt.Sprintf("%s needs an order of at least $%.2f", p.Code, p.MinTotal)
+				continue
+			}
+		}
+		if pr.Subtotal >= p.MinTotal {
+			eligible = append(eligible, p)
+		}
+	}
+	if code != "" && !codeFound {
+		pr.CodeProblem = code + " is not a valid code"
+	}
+
+	lineDiscounts := 0.0
+	for _, item := range items {
+		line := pricedLine{cartItem: item}
+		for i := range eligible {
+			if d := roundCents(eligible[i].lineDiscount(item)); d > line.Discount {
+				line.Discount, line.Promotion = d, &eligible[i]
+			}
+		}
+		lineDiscounts += line.Discount
+		pr.Lines = append(pr.Lines, line)
+	}
+	for i := range eligible {
+		if !eligible[i].orderLevel() {
+			continue
+		}
+		if d := roundCents(math.Min(eligible[i].Amount, pr.Subtotal-lineDiscounts)); d > pr.OrderDiscount {
+			pr.OrderDiscount, pr.OrderPromotion = d, &eligible[i]
+		}
+	}
+
+	if code != "" && codeFound && pr.CodeProblem == "" {
+		used := false
+		for _, p := range pr.Applied() {
+			used = used || strings.EqualFold(p.Code, code)
+		}
+		if !used {
+			pr.CodeProblem = code + " does not improve on the discounts you already have"
+		}
+	}
+
+	pr.Discount = roundCents(lineDiscounts + pr.OrderDiscount)
+	pr.Total = roundCents(pr.Subtotal - pr.Discount)
+	return pr
+}
+
+// shelfPromotions are the request's promotions that change an album's
+// shelf price: automatic ones with no minimum order, which a single copy
+// can get. They are loaded once per request, on first use.
+type shelfPromotions struct {
+	once       sync.Once
+	promotions []promotion
+	err        error
+}
+
+type shelfPromotionsKey struct{}
+
+// promotionPrices makes shelf promotions available to the request's
+// templates.
+func promotionPrices() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(withShelfPromotions(c.Request.Context()))
+		c.Next()
+	}
+}
+
+// withShelfPromotions gives ctx its own shelf promotions, loaded when
+// first needed.
+func withShelfPromotions(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shelfPromotionsKey{}, &shelfPromotions{})
+}
+
+func loadShelfPromotions(ctx context.Context) ([]promotion, error) {
+	sp, ok := ctx.Value(shelfPromotionsKey{}).(*shelfPromotions)
+	if !ok {
+		return nil, nil
+	}
+	sp.once.Do(func() {
+		all, err := queryPromotions(db, "SELECT "+promotionColumns+" WHERE "+promotionCurrent+`
+            AND promotions.code = '' AND promotions.min_total = 0 AND promotions.kind <> 'buy_x_get_y'
+            ORDER BY promotions.id`)
+		for _, p := range all {
+			if !p.orderLevel() {
+				sp.promotions = append(sp.promotions, p)
+			}
+		}
+		sp.err = err
+	})
+	return sp.promotions, sp.err
+}
+
+// shelfPromotionsTag identifies the shelf promotions in force, for
+// ETags of pages that show effective prices. Promotions start and end
+// without the catalog changing, so the catalog revision alone is not
+// enough.
+func shelfPromotionsTag(ctx context.Context) (string, error) {
+	promotions, err := loadShelfPromotions(ctx)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range promotions {
+		fmt.Fprintf(&b, "%s@%d;", p.ID, p.UpdatedAt.UnixMicro())
+	}
+	return sha256Hex([]byte(b.String()))[:12], nil
+}
+
+// effectivePrice is what one copy of an album costs after shelf
+// promotions. ok is false when no promotion lowers the price, or they
+// could not be loaded; the list price stands then.
+func effectivePrice(ctx context.Context, a album) (price float64, ok bool) {
+	promotions, err := loadShelfPromotions(ctx)
+	if err != nil || len(promotions) == 0 {
+		return a.Price, false
+	}
+	pr := evaluatePromotions([]cartItem{{Album: a, Quantity: 1}}, promotions, "")
+	if pr.Discount <= 0 {
+		return a.Price, false
+	}
+	return pr.Total, true
+}
+
+// redeemPromotions counts the promotions an order used against their
+// usage limits, in tx. It fails with errPromotionUsedUp if one ran out
+// since the cart was priced.
+func redeemPromotions(tx *sql.Tx, orderID string, pr pricing) error {
+	discounts := map[string]float64{}
+	for _, l := range pr.Lines {
+		if l.Promotion != nil {
+			discounts[l.Promotion.ID] += l.Discount
+		}
+	}
+	if pr.OrderPromotion != nil {
+		discounts[pr.OrderPromotion.ID] += pr.OrderDiscount
+	}
+	for _, p := range pr.Applied() {
+		res, err := tx.Exec(`
+            UPDATE promotions SET times_used = times_used + 1
+            WHERE id = $1 AND (usage_limit IS NULL OR times_used < usage_limit)`, p.ID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w: %s", errPromotionUsedUp, p.Name)
+		}
+		_, err = tx.Exec("INSERT INTO promotion_redemptions (order_id, promotion_id, discount) VALUES ($1, $2, $3)",
+			orderID, p.ID, roundCents(discounts[p.ID]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errPromotionUsedUp = errors.New("promotion has been used up")
+
+// releasePromotions gives a cancelled order's promotion uses back, in tx.
+func releasePromotions(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(`
+        UPDATE promotions SET times_used = times_used - 1
+        FROM promotion_redemptions
+        WHERE promotion_redemptions.promotion_id = promotions.id AND promotion_redemptions.order_id = $1`, orderID)
+	return err
+}
+
+// cartCode is the discount code the session entered, if any.
+func cartCode(q querier, session string) (string, error) {
+	var code string
+	err := q.QueryRow("SELECT code FROM cart_codes WHERE session_id = $1", session).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return code, err
+}
+
+// priceCart loads a session's cart and prices it with the promotions in
+// force and the session's code.
+func priceCart(q querier, session string) (pricing, error) {
+	ct, err := loadCart(q, session)
+	if err != nil {
+		return pricing{}, err
+	}
+	code := ""
+	if session != "" {
+		if code, err = cartCode(q, session); err != nil {
+			return pricing{}, err
+		}
+	}
+	promotions, err := currentPromotions(q, code)
+	if err != nil {
+		return pricing{}, err
+	}
+	return evaluatePromotions(ct.Items, promotions, code), nil
+}
+
+// postCartCode enters a discount code for the cart, replacing any other.
+// Codes that do not exist or have expired are refused; one that exists but
+// does not help this cart is kept, and the cart says why.
+func postCartCode(c *gin.Context) {
+	code := strings.TrimSpace(c.PostForm("code"))
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM promotions WHERE lower(code) = lower($1) AND "+promotionCurrent+")", code).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": code + " is not a valid code"})
+		return
+	}
+	session := sessionID(c, true)
+	_, err = db.Exec(`
+        INSERT INTO cart_codes (session_id, code) VALUES ($1, $2)
+        ON CONFLICT (session_id) DO UPDATE SET code = EXCLUDED.code, updated_at = now()`, session, code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cartResponse(c, session, http.StatusOK)
+}
+
+func deleteCartCode(c *gin.Context) {
+	session := sessionID(c, false)
+	if session != "" {
+		if _, err := db.Exec("DELETE FROM cart_codes WHERE session_id = $1", session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	cartResponse(c, session, http.StatusOK)
+}
+
+// getPromotions lists every promotion, for staff.
+func getPromotions(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage promotions"})
+		return
+	}
+	promotions, err := queryPromotions(db, "SELECT "+promotionColumns+" ORDER BY promotions.active DESC, promotions.id DESC")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, PromotionList(promotions))
+	case "json":
+		c.JSON(http.StatusOK, promotions)
+	default:
+		render(c, 200, PromotionsPage(promotions))
+	}
+}
+
+// bindPromotion reads a promotion from the form. Blank optional fields
+// leave the promotion unrestricted in that respect.
+func bindPromotion(c *gin.Context) (promotion, string, error) {
+	p := promotion{
+		Name:   strings.TrimSpace(c.PostForm("name")),
+		Code:   strings.ToUpper(strings.TrimSpace(c.PostForm("code"))),
+		Kind:   c.PostForm("kind"),
+		Genre:  strings.TrimSpace(c.PostForm("genre")),
+		Active: true,
+	}
+	artistName := normalizeArtistName(c.PostForm("artist"))
+	if p.Name == "" {
+		return p, "", fmt.Errorf("name is required")
+	}
+	if !slices.Contains(promotionKinds, p.Kind) {
+		return p, "", fmt.Errorf("kind must be one of %s", strings.Join(promotionKinds, ", "))
+	}
+
+	number := func(field string) (float64, error) {
+		v := strings.TrimSpace(c.PostForm(field))
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("Invalid %s", field)
+		}
+		return f, nil
+	}
+	count := func(field string) (int, error) {
+		v := strings.TrimSpace(c.PostForm(field))
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Invalid %s", field)
+		}
+		return n, nil
+	}
+	var err error
+	if p.Amount, err = number("amount"); err != nil {
+		return p, "", err
+	}
+	if p.MinTotal, err = number("min_total"); err != nil {
+		return p, "", err
+	}
+	if p.BuyQuantity, err = count("buy_quantity"); err != nil {
+		return p, "", err
+	}
+	if p.GetQuantity, err = count("get_quantity"); err != nil {
+		return p, "", err
+	}
+	switch p.Kind {
+	case "percent":
+		if p.Amount <= 0 || p.Amount > 100 {
+			return p, "", fmt.Errorf("a percentage must be between 0 and 100")
+		}
+	case "fixed":
+		if p.Amount <= 0 {
+			return p, "", fmt.Errorf("amount is required")
+		}
+	case "buy_x_get_y":
+		if p.BuyQuantity < 1 || p.GetQuantity < 1 {
+			return p, "", fmt.Errorf("buy_quantity and get_quantity are required")
+		}
+	}
+	if v := c.PostForm("usage_limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, "", fmt.Errorf("Invalid usage_limit")
+		}
+		p.UsageLimit = &n
+	}
+	for field, dst := range map[string]**time.Time{"starts_at": &p.StartsAt, "ends_at": &p.EndsAt} {
+		if v := c.PostForm(field); v != "" {
+			t, err := parseScheduleTime(c, v)
+			if err != nil {
+				return p, "", fmt.Errorf("Invalid %s", field)
+			}
+			*dst = &t
+		}
+	}
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		return p, "", fmt.Errorf("ends_at must be after starts_at")
+	}
+	return p, artistName, nil
+}
+
+func postPromotion(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage promotions"})
+		return
+	}
+	p, artistName, err := bindPromotion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Unlike an album, a promotion does not bring an artist into being: a
+	// name nobody goes by is a typo.
+	var artistID any
+	if artistName != "" {
+		var id string
+		err = db.QueryRow(`
+            SELECT id FROM artists WHERE lower(name) = lower($1)
+            UNION ALL
+            SELECT artist_id FROM artist_aliases WHERE lower(alias) = lower($1)
+            LIMIT 1`, artistName).Scan(&id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no artist is called " + artistName})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		artistID = id
+	}
+	var id string
+	err = db.QueryRow(`
+        INSERT INTO promotions (name, code, kind, amount, artist_id, genre, buy_quantity, get_quantity,
+            min_total, starts_at, ends_at, usage_limit)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        RETURNING id`, p.Name, p.Code, p.Kind, p.Amount, artistID, p.Genre, p.BuyQuantity, p.GetQuantity,
+		p.MinTotal, p.StartsAt, p.EndsAt, p.UsageLimit).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+		c.JSON(http.StatusConflict, gin.H{"error": "another promotion uses the code " + p.Code})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if p, err = scanPromotion(db.QueryRow("SELECT "+promotionColumns+" WHERE promotions.id = $1", id)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		getPromotions(c)
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+// deletePromotion switches a promotion off. It stays on record for the
+// orders that used it.
+func deletePromotion(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage promotions"})
+		return
+	}
+	res, err := db.Exec("UPDATE promotions SET active = false, updated_at = now() WHERE id = $1 AND active", c.Param("promotionID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "promotion not found"})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		getPromotions(c)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
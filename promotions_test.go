@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestEvaluatePromotions(t *testing.T) {
+	jazz := album{ID: "1", Title: "Blue Train", Price: 20, Genres: []string{"Jazz"}}
+	single := album{ID: "2", Title: "Jeru", Price: 10}
+
+	tests := []struct {
+		name       string
+		items      []cartItem
+		promotions []promotion
+		code       string
+
+		discount      float64
+		orderDiscount float64
+		total         float64
+		linePromotion string
+		codeProblem   string
+	}{
+		{
+			name:  "best line discount wins",
+			items: []cartItem{{Album: jazz, Quantity: 1}},
+			promotions: []promotion{
+				{ID: "10", Kind: "percent", Amount: 10},
+				{ID: "11", Kind: "fixed", Amount: 3, Genre: "jazz"},
+			},
+			discount:      3,
+			total:         17,
+			linePromotion: "11",
+		},
+		{
+			name:  "order discount is capped at what is left",
+			items: []cartItem{{Album: single, Quantity: 1}},
+			promotions: []promotion{
+				{ID: "20", Kind: "percent", Amount: 50},
+				{ID: "21", Kind: "fixed", Amount: 20},
+			},
+			discount:      10,
+			orderDiscount: 5,
+			total:         0,
+			linePromotion: "20",
+		},
+		{
+			name:  "code below its minimum",
+			items: []cartItem{{Album: jazz, Quantity: 1}},
+			promotions: []promotion{
+				{ID: "30", Code: "SAVE10", Kind: "percent", Amount: 10, MinTotal: 50},
+			},
+			code:        "save10",
+			total:       20,
+			codeProblem: "SAVE10 needs an order of at least $50.00",
+		},
+		{
+			name:  "buy 2 get 1 with 5 copies",
+			items: []cartItem{{Album: single, Quantity: 5}},
+			promotions: []promotion{
+				{ID: "40", Kind: "buy_x_get_y", BuyQuantity: 2, GetQuantity: 1},
+			},
+			discount:      10,
+			total:         40,
+			linePromotion: "40",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr := evaluatePromotions(tt.items, tt.promotions, tt.code)
+			if pr.Discount != tt.discount || pr.OrderDiscount != tt.orderDiscount || pr.Total != tt.total {
+				t.Errorf("discount, order discount, total = %.2f, %.2f, %.2f; want %.2f, %.2f, %.2f",
+					pr.Discount, pr.OrderDiscount, pr.Total, tt.discount, tt.orderDiscount, tt.total)
+			}
+			got := ""
+			if p := pr.Lines[0].Promotion; p != nil {
+				got = p.ID
+			}
+			if got != tt.linePromotion {
+				t.Errorf("line promotion = %q, want %q", got, tt.linePromotion)
+			}
+			if pr.CodeProblem != tt.codeProblem {
+				t.Errorf("code problem = %q, want %q", pr.CodeProblem, tt.codeProblem)
+			}
+		})
+	}
+}
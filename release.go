@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// release describes the pressing an album is, so that several pressings of
+// one title can be told apart. Zero values mean unknown.
+type release struct {
+	Year          int    `json:"year,omitempty"`
+	Label         string `json:"label"`
+	Format        string `json:"format"`
+	CatalogNumber string `json:"catalog_number"`
+	Barcode       string `json:"barcode"`
+}
+
+type releaseFormat struct {
+	Key   string
+	Label string
+}
+
+// releaseFormats must match the albums_format check constraint.
+var releaseFormats = []releaseFormat{
+	{Key: "vinyl", Label: "Vinyl"},
+	{Key: "cd", Label: "CD"},
+	{Key: "cassette", Label: "Cassette"},
+	{Key: "digital", Label: "Digital"},
+}
+
+func formatLabel(key string) string {
+	for _, f := range releaseFormats {
+		if f.Key == key {
+			return f.Label
+		}
+	}
+	return key
+}
+
+// firstReleaseYear is the year of the earliest commercial recordings.
+const firstReleaseYear = 1877
+
+// bindRelease overwrites the fields of r that the request sent, so API
+// clients that predate them keep the stored values.
+func bindRelease(get albumValues, r *release) error {
+	if v, ok := get("year"); ok {
+		v = strings.TrimSpace(v)
+		r.Year = 0
+		if v != "" {
+			year, err := strconv.Atoi(v)
+			if err != nil || year < firstReleaseYear || year > time.Now().Year()+1 {
+				return fmt.Errorf("year must be between %d and %d", firstReleaseYear, time.Now().Year()+1)
+			}
+			r.Year = year
+		}
+	}
+	if v, ok := get("label"); ok {
+		r.Label = normalizeArtistName(v)
+	}
+	if v, ok := get("format"); ok {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v != "" && formatLabel(v) == v {
+			return errors.New("format must be vinyl, cd, cassette or digital")
+		}
+		r.Format = v
+	}
+	if v, ok := get("catalog_number"); ok {
+		r.CatalogNumber = strings.ToUpper(normalizeArtistName(v))
+	}
+	if v, ok := get("barcode"); ok {
+		barcode, err := normalizeBarcode(v)
+		if err != nil {
+			return err
+		}
+		r.Barcode = barcode
+	}
+	return nil
+}
+
+// normalizeBarcode strips the spaces and hyphens printed in barcodes and
+// checks the result is a UPC-A, EAN-13 or EAN-8 with a valid check digit.
+func normalizeBarcode(s string) (string, error) {
+	s = strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if s == "" {
+		return "", nil
+	}
+	if len(s) != 8 && len(s) != 12 && len(s) != 13 {
+		return "", errors.New("barcode must be a UPC-A (12 digits), EAN-13 or EAN-8")
+	}
+	sum := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		d := s[i]
+		if d < '0' || d > '9' {
+			return "", errors.New("barcode must contain only digits")
+		}
+		// Counting from the check digit, every other digit weighs 3.
+		if (len(s)-1-i)%2 == 1 {
+			sum += 3 * int(d-'0')
+		} else {
+			sum += int(d - '0')
+		}
+	}
+	if sum%10 != 0 {
+		return "", errors.New("barcode check digit is wrong")
+	}
+	return s, nil
+}
+
+// releaseConflict explains a violation of the per-format uniqueness rules.
+func releaseConflict(err error) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return "", false
+	}
+	switch pqErr.Constraint {
+	case "albums_format_barcode":
+		return "another album in this format has that barcode", true
+	case "albums_format_catalog_number":
+		return "another album in this format has that label and catalog number", true
+	}
+	return "", false
+}
+
+// releaseSummary is the one-line description shown on album cards.
+func releaseSummary(r release) string {
+	var parts []string
+	if r.Year != 0 {
+		parts = append(parts, strconv.Itoa(r.Year))
+	}
+	if r.Format != "" {
+		parts = append(parts, formatLabel(r.Format))
+	}
+	if r.Label != "" {
+		parts = append(parts, r.Label)
+	}
+	if r.CatalogNumber != "" {
+		parts = append(parts, r.CatalogNumber)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// yearValue is the form value for a release year, blank when unknown.
+func yearValue(year int) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(year)
+}
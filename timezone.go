@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo
+
+	"github.com/gin-gonic/gin"
+)
+
+const timeZoneCookie = "tz"
+
+// timeZones are offered in the time zone picker. Any IANA name is accepted
+// from the cookie; these are just the common ones.
+var timeZones = []string{
+	"UTC",
+	"Pacific/Honolulu",
+	"America/Anchorage",
+	"America/Los_Angeles",
+	"America/Denver",
+	"America/Chicago",
+	"America/New_York",
+	"America/Sao_Paulo",
+	"Atlantic/Reykjavik",
+	"Europe/London",
+	"Europe/Paris",
+	"Europe/Berlin",
+	"Europe/Helsinki",
+	"Europe/Moscow",
+	"Africa/Lagos",
+	"Africa/Johannesburg",
+	"Asia/Dubai",
+	"Asia/Kolkata",
+	"Asia/Bangkok",
+	"Asia/Shanghai",
+	"Asia/Tokyo",
+	"Australia/Sydney",
+	"Pacific/Auckland",
+}
+
+type locationKey struct{}
+
+// timeZone puts the location from the tz cookie on the request context so
+// templates can show times in it. It falls back to UTC.
+func timeZone() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loc := time.UTC
+		if name, err := c.Cookie(timeZoneCookie); err == nil {
+			if l, err := loadTimeZone(name); err == nil {
+				loc = l
+			}
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), locationKey{}, loc))
+		c.Next()
+	}
+}
+
+func loadTimeZone(name string) (*time.Location, error) {
+	// LoadLocation maps these to the server's zone rather than a real one.
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+func userLocation(ctx context.Context) *time.Location {
+	if loc, ok := ctx.Value(locationKey{}).(*time.Location); ok {
+		return loc
+	}
+	return time.UTC
+}
+
+func formatDate(ctx context.Context, t time.Time) string {
+	return t.In(userLocation(ctx)).Format("Jan 2, 2006")
+}
+
+func formatDateTime(ctx context.Context, t time.Time) string {
+	return t.In(userLocation(ctx)).Format("Jan 2, 2006 15:04")
+}
+
+func relativeTime(ctx context.Context, t time.Time) string {
+	return relativeTimeAt(t, time.Now(), userLocation(ctx))
+}
+
+// relativeTimeAt describes t as seen at now. Anything before today is
+// described by calendar day in loc, so "yesterday" means the user's
+// yesterday rather than the server's.
+func relativeTimeAt(t, now time.Time, loc *time.Location) string {
+	t, now = t.In(loc), now.In(loc)
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute") + " ago"
+	}
+
+	day := func(t time.Time) time.Time {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	days := int(day(now).Sub(day(t)).Hours()+12) / 24
+	switch {
+	case days == 0:
+		return plural(int(d/time.Hour), "hour") + " ago"
+	case days == 1:
+		return "yesterday at " + t.Format("15:04")
+	case days < 7:
+		return t.Format("Monday") + " at " + t.Format("15:04")
+	case t.Year() == now.Year():
+		return t.Format("Jan 2")
+	default:
+		return t.Format("Jan 2, 2006")
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func setTimeZone(c *gin.Context) {
+	name := c.PostForm("tz")
+	if _, err := loadTimeZone(name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(timeZoneCookie, name, 365*24*60*60, "/", "", false, true)
+
+	// Every time on the page changes, so reload it rather than patch it.
+	if c.GetHeader("HX-Request") == "true" {
+		c.Header("HX-Refresh", "true")
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/recent")
+}
+
+// recentLimit is how many albums the recent view lists.
+const recentLimit = 20
+
+func getRecent(c *gin.Context) {
+	sort := c.DefaultQuery("sort", "added")
+	var order string
+	switch sort {
+	case "added":
+		order = "created_at"
+	case "changed":
+		order = "updated_at"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be added or changed"})
+		return
+	}
+
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE deleted_at IS NULL ORDER BY "+order+" DESC, id DESC LIMIT $1", recentLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, RecentList(sort, albums))
+	case "json":
+		c.JSON(http.StatusOK, albums)
+	default:
+		render(c, 200, RecentPage(sort, albums))
+	}
+}
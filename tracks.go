@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type track struct {
+	ID       string `json:"id"`
+	AlbumID  string `json:"album_id"`
+	Disc     int    `json:"disc_number"`
+	Position int    `json:"position"`
+	Title    string `json:"title"`
+	Duration int    `json:"duration_seconds"`
+	ISRC     string `json:"isrc,omitempty"`
+}
+
+// trackColumns lists the columns scanTrack reads, in order.
+const trackColumns = "id, album_id, disc_number, position, title, duration_seconds, COALESCE(isrc, '')"
+
+func scanTrack(row scanner) (track, error) {
+	var t track
+	err := row.Scan(&t.ID, &t.AlbumID, &t.Disc, &t.Position, &t.Title, &t.Duration, &t.ISRC)
+	return t, err
+}
+
+func queryTracks(q querier, albumID string) ([]track, error) {
+	rows, err := q.Query("SELECT "+trackColumns+" FROM tracks WHERE album_id = $1 ORDER BY disc_number, position", albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []track
+	for rows.Next() {
+		t, err := scanTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// totalRuntime adds up the durations of tracks, in seconds.
+func totalRuntime(tracks []track) int {
+	total := 0
+	for _, t := range tracks {
+		total += t.Duration
+	}
+	return total
+}
+
+func multiDisc(tracks []track) bool {
+	for _, t := range tracks {
+		if t.Disc != 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func trackLabel(t track, multiDisc bool) string {
+	if multiDisc {
+		return fmt.Sprintf("%d-%02d", t.Disc, t.Position)
+	}
+	return strconv.Itoa(t.Position)
+}
+
+// formatDuration renders seconds as m:ss, or h:mm:ss from an hour up.
+func formatDuration(seconds int) string {
+	h, m, s := seconds/3600, seconds/60%60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// parseDuration accepts plain seconds, m:ss or h:mm:ss.
+func parseDuration(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	total := 0
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (i > 0 && n >= 60) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total = total*60 + n
+	}
+	return total, nil
+}
+
+var isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$`)
+
+// normalizeISRC strips the optional hyphens from an ISRC such as
+// US-RC1-76-07839 and checks what is left has the right shape.
+func normalizeISRC(s string) (string, error) {
+	isrc := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), "-", ""))
+	if isrc != "" && !isrcPattern.MatchString(isrc) {
+		return "", fmt.Errorf("invalid ISRC %q", s)
+	}
+	return isrc, nil
+}
+
+// trackInput is what the track form and JSON clients send. JSON clients
+// may give duration_seconds instead of a formatted duration.
+type trackInput struct {
+	Title           string `form:"title" json:"title"`
+	Duration        string `form:"duration" json:"duration"`
+	DurationSeconds *int   `form:"-" json:"duration_seconds"`
+	Disc            int    `form:"disc_number" json:"disc_number"`
+	Position        int    `form:"position" json:"position"`
+	ISRC            string `form:"isrc" json:"isrc"`
+}
+
+// bindTrack validates the request body into t. Disc defaults to 1 and a
+// zero position means the end of the disc.
+func bindTrack(c *gin.Context, t *track) error {
+	var in trackInput
+	if err := c.ShouldBind(&in); err != nil {
+		return err
+	}
+	if strings.TrimSpace(in.Title) == "" {
+		return fmt.Errorf("title is required")
+	}
+	t.Title = strings.TrimSpace(in.Title)
+
+	switch {
+	case in.DurationSeconds != nil:
+		if *in.DurationSeconds < 0 {
+			return fmt.Errorf("duration must not be negative")
+		}
+		t.Duration = *in.DurationSeconds
+	case in.Duration != "":
+		d, err := parseDuration(in.Duration)
+		if err != nil {
+			return err
+		}
+		t.Duration = d
+	default:
+		return fmt.Errorf("duration is required")
+	}
+
+	if in.Disc < 0 || in.Position < 0 {
+		return fmt.Errorf("disc and position must not be negative")
+	}
+	t.Disc = max(in.Disc, 1)
+	t.Position = in.Position
+
+	isrc, err := normalizeISRC(in.ISRC)
+	if err != nil {
+		return err
+	}
+	t.ISRC = isrc
+	return nil
+}
+
+// placeTrack makes room for t at its requested disc and position, shifting
+// later tracks down, and clamps the position to the end of the disc. t must
+// already have been taken out of its old slot, and the caller must hold
+// the album's lock from lockTracks.
+func placeTrack(tx *sql.Tx, t *track) error {
+	var count int
+	err := tx.QueryRow("SELECT count(*) FROM tracks WHERE album_id = $1 AND disc_number = $2 AND id::text <> $3", t.AlbumID, t.Disc, t.ID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if t.Position < 1 || t.Position > count+1 {
+		t.Position = count + 1
+	}
+	_, err = tx.Exec("UPDATE tracks SET position = position + 1 WHERE album_id = $1 AND disc_number = $2 AND position >= $3 AND id::text <> $4", t.AlbumID, t.Disc, t.Position, t.ID)
+	return err
+}
+
+// lockTracks takes the album's lock in tx before its track list is
+// renumbered, so concurrent changes to the list queue up instead of both
+// counting the same positions. It answers 404 and reports false if the
+// album is gone or in the trash.
+func lockTracks(c *gin.Context, tx *sql.Tx, albumID string) bool {
+	_, err := lockAlbum(tx, albumID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// commitTracks commits a change to a track list. Positions are checked
+// for uniqueness at commit, and a clash left over despite lockTracks is a
+// conflict rather than a server error.
+func commitTracks(c *gin.Context, tx *sql.Tx) bool {
+	err := tx.Commit()
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+		c.JSON(http.StatusConflict, gin.H{"error": "the track list changed at the same time; try again"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// closeGap shifts the tracks after a removed slot up by one.
+func closeGap(tx *sql.Tx, albumID string, disc, position int) error {
+	_, err := tx.Exec("UPDATE tracks SET position = position - 1 WHERE album_id = $1 AND disc_number = $2 AND position > $3", albumID, disc, position)
+	return err
+}
+
+// trackResponse answers a track change: htmx gets the redrawn list, since
+// positions and the total runtime may all have moved; API clients get the
+// track itself.
+func trackResponse(c *gin.Context, status int, albumID string, t track) {
+	if c.GetHeader("HX-Request") != "true" {
+		c.JSON(status, t)
+		return
+	}
+	tracks, err := queryTracks(db, albumID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	render(c, 200, TrackList(albumID, tracks))
+}
+
+// requireAlbum answers 404 and returns false unless the album in the path
+// exists and is not in the trash.
+func requireAlbum(c *gin.Context) bool {
+	_, err := fetchAlbum(c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func getTracks(c *gin.Context) {
+	if !requireAlbum(c) {
+		return
+	}
+	albumID := c.Param("id")
+	tracks, err := queryTracks(db, albumID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, TrackList(albumID, tracks))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tracks": tracks, "total_duration_seconds": totalRuntime(tracks)})
+}
+
+func getTrackByID(c *gin.Context) {
+	albumID := c.Param("id")
+	t, err := scanTrack(db.QueryRow("SELECT "+trackColumns+" FROM tracks WHERE id = $1 AND album_id = $2", c.Param("trackID"), albumID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.GetHeader("getReq") {
+	case "update":
+		render(c, 200, TrackForm(t))
+	case "cancel":
+		tracks, err := queryTracks(db, albumID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		render(c, 200, TrackRow(t, multiDisc(tracks)))
+	default:
+		c.JSON(http.StatusOK, t)
+	}
+}
+
+func postTrack(c *gin.Context) {
+	if !requireAlbum(c) {
+		return
+	}
+	t := track{AlbumID: c.Param("id")}
+	if err := bindTrack(c, &t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !lockTracks(c, tx, t.AlbumID) {
+		return
+	}
+	if err = placeTrack(tx, &t); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	insertSQL := `
+        INSERT INTO tracks (album_id, disc_number, position, title, duration_seconds, isrc)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+        RETURNING ` + trackColumns + `;
+	`
+	t, err = scanTrack(tx.QueryRow(insertSQL, t.AlbumID, t.Disc, t.Position, t.Title, t.Duration, t.ISRC))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !commitTracks(c, tx) {
+		return
+	}
+	trackResponse(c, http.StatusCreated, t.AlbumID, t)
+}
+
+func updateTrackByID(c *gin.Context) {
+	if !requireAlbum(c) {
+		return
+	}
+	albumID := c.Param("id")
+	t := track{ID: c.Param("trackID"), AlbumID: albumID}
+	if err := bindTrack(c, &t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !lockTracks(c, tx, albumID) {
+		return
+	}
+	current, err := scanTrack(tx.QueryRow("SELECT "+trackColumns+" FROM tracks WHERE id = $1 AND album_id = $2 FOR UPDATE", t.ID, albumID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if t.Position == 0 && t.Disc == current.Disc {
+		t.Position = current.Position
+	}
+	if t.Disc != current.Disc || t.Position != current.Position {
+		if err = closeGap(tx, albumID, current.Disc, current.Position); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err = placeTrack(tx, &t); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	updateSQL := `
+        UPDATE tracks
+        SET disc_number = $1, position = $2, title = $3, duration_seconds = $4, isrc = NULLIF($5, '')
+        WHERE id = $6
+        RETURNING ` + trackColumns + `;
+	`
+	t, err = scanTrack(tx.QueryRow(updateSQL, t.Disc, t.Position, t.Title, t.Duration, t.ISRC, t.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !commitTracks(c, tx) {
+		return
+	}
+	trackResponse(c, http.StatusOK, albumID, t)
+}
+
+func deleteTrackByID(c *gin.Context) {
+	if !requireAlbum(c) {
+		return
+	}
+	albumID := c.Param("id")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !lockTracks(c, tx, albumID) {
+		return
+	}
+	deleted, err := scanTrack(tx.QueryRow("DELETE FROM tracks WHERE id = $1 AND album_id = $2 RETURNING "+trackColumns, c.Param("trackID"), albumID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = closeGap(tx, albumID, deleted.Disc, deleted.Position); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !commitTracks(c, tx) {
+		return
+	}
+	trackResponse(c, http.StatusOK, albumID, deleted)
+}
+
+// reorderTracks renumbers an album's tracks in the order their IDs are
+// given in the track field, which is how the drag-and-drop list submits.
+// Tracks keep their disc; positions count up separately on each disc.
+func reorderTracks(c *gin.Context) {
+	if !requireAlbum(c) {
+		return
+	}
+	albumID := c.Param("id")
+	var order []string
+	if c.ContentType() == gin.MIMEJSON {
+		if err := c.ShouldBindJSON(&order); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		order = c.PostFormArray("track")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !lockTracks(c, tx, albumID) {
+		return
+	}
+	tracks, err := queryTracks(tx, albumID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	discs := make(map[string]int, len(tracks))
+	for _, t := range tracks {
+		discs[t.ID] = t.Disc
+	}
+	if len(order) != len(tracks) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must list every track of the album once"})
+		return
+	}
+	positions := make(map[int]int)
+	for _, id := range order {
+		disc, ok := discs[id]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order must list every track of the album once"})
+			return
+		}
+		delete(discs, id)
+		positions[disc]++
+		if _, err = tx.Exec("UPDATE tracks SET position = $1 WHERE id = $2", positions[disc], id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if !commitTracks(c, tx) {
+		return
+	}
+
+	tracks, err = queryTracks(db, albumID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, TrackList(albumID, tracks))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tracks": tracks, "total_duration_seconds": totalRuntime(tracks)})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultTrashRetention is how long a deleted album stays restorable when
+// TRASH_RETENTION is not set.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashRetention is how long trashed albums are kept, set from
+// TRASH_RETENTION at startup.
+var trashRetention = defaultTrashRetention
+
+// purgeInterval is how often purgeTrash looks for expired albums, and how
+// often the other housekeeping jobs run.
+const purgeInterval = time.Hour
+
+func getTrash(c *gin.Context) {
+	albums, err := queryAlbums(db, "SELECT "+albumColumns+" FROM albums WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, TrashList(albums))
+	case "json":
+		c.JSON(http.StatusOK, albums)
+	default:
+		render(c, 200, TrashPage(albums))
+	}
+}
+
+func restoreAlbumByID(c *gin.Context) {
+	id := c.Param("id")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	trashed, err := scanAlbum(tx.QueryRow("SELECT "+albumColumns+" FROM albums WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found in trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	restoreSQL := `
+        UPDATE albums
+        SET deleted_at = NULL, updated_at = now(), version = version + 1
+        WHERE id = $1
+        RETURNING ` + albumColumns + `;
+	`
+	restored, err := scanAlbum(tx.QueryRow(restoreSQL, id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = recordAudit(tx, c, "restore", &trashed, &restored); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch {
+	case c.GetHeader("HX-Target") == "albums-div":
+		// Undo from the toast: redraw the list and dismiss the toast.
+		filter := parseBrowseFilter(c)
+		albums, err := listAlbums(filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		fs, err := loadFacets(filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		render(c, 200, templ.Join(AlbumsDiv(albums, filter), Facets(fs, true), ClearToast()))
+	case c.GetHeader("HX-Request") == "true":
+		// The trash card removes itself with hx-swap="delete".
+		c.Status(http.StatusOK)
+	default:
+		c.JSON(http.StatusOK, restored)
+	}
+}
+
+func purgeAlbumByID(c *gin.Context) {
+	id := c.Param("id")
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	purged, err := scanAlbum(tx.QueryRow("DELETE FROM albums WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+albumColumns, id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found in trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = recordAudit(tx, c, "purge", &purged, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	removeCover(purged.Cover)
+
+	// htmx does not swap 204 responses, so the trash card needs a 200 to
+	// remove itself.
+	if c.GetHeader("HX-Request") == "true" {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// purgeTrash permanently deletes albums that have been in the trash for
+// longer than trashRetention.
+func purgeTrash(ctx context.Context, _ struct{}) error {
+	n, err := purgeExpired(trashRetention)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Purged %d albums from trash", n)
+	}
+	return nil
+}
+
+var purgeTrashJob = registerJob("purge_trash", jobOptions{Every: purgeInterval}, purgeTrash)
+
+func purgeExpired(retention time.Duration) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	purged, err := queryAlbums(tx, "DELETE FROM albums WHERE deleted_at < now() - make_interval(secs => $1) RETURNING "+albumColumns, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range purged {
+		if err := recordAudit(tx, nil, "purge", &a, nil); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, a := range purged {
+		removeCover(a.Cover)
+	}
+	return len(purged), nil
+}
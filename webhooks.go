@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// webhookEvents are the events an endpoint can subscribe to. An endpoint
+// with no events chosen gets all of them.
+var webhookEvents = []string{"album.created", "album.updated", "album.deleted"}
+
+// webhookEventForAction maps audit actions to the event they send.
+// Restoring an album from the trash brings it back, so it counts as a
+// creation; purging one already in the trash sends nothing.
+var webhookEventForAction = map[string]string{
+	"create":  "album.created",
+	"update":  "album.updated",
+	"delete":  "album.deleted",
+	"restore": "album.created",
+}
+
+const (
+	// webhookPollInterval is how often the deliver_webhooks job checks
+	// the outbox for deliveries that are due.
+	webhookPollInterval = 5 * time.Second
+
+	// webhookTimeout bounds one delivery attempt.
+	webhookTimeout = 10 * time.Second
+
+	// A failed delivery is retried after webhookBaseDelay, doubling each
+	// time up to webhookMaxDelay. After webhookMaxAttempts it is dead and
+	// only sent again if someone redelivers it.
+	webhookBaseDelay   = 30 * time.Second
+	webhookMaxDelay    = 2 * time.Hour
+	webhookMaxAttempts = 10
+
+	// webhookDeliveryLimit caps the delivery log shown for an endpoint.
+	webhookDeliveryLimit = 100
+)
+
+var errWebhookTarget = errors.New("webhooks may not be sent to loopback, private or link-local addresses")
+
+// webhookClient sends deliveries. It checks every address it connects to,
+// redirects included, so a name that resolved to a public address when
+// the endpoint was registered cannot be pointed inside the network later.
+// It goes direct, as a proxy would hide the address it connects to.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = nil
+		t.DialContext = (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+					return errWebhookTarget
+				}
+				return nil
+			},
+		}).DialContext
+		return t
+	}(),
+}
+
+// internalIP reports whether ip belongs to this host or its network,
+// where webhooks must not reach.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// checkWebhookHost refuses hosts that resolve to an internal address.
+func checkWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return errWebhookTarget
+		}
+	}
+	return nil
+}
+
+type webhookEndpoint struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Subscribes reports whether the endpoint wants an event.
+func (e webhookEndpoint) Subscribes(event string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, event)
+}
+
+const webhookEndpointColumns = "id, url, description, events, secret, active, created_at"
+
+func scanWebhookEndpoint(row scanner) (webhookEndpoint, error) {
+	var e webhookEndpoint
+	err := row.Scan(&e.ID, &e.URL, &e.Description, pq.Array(&e.Events), &e.Secret, &e.Active, &e.CreatedAt)
+	return e, err
+}
+
+func queryWebhookEndpoints(query string, args ...any) ([]webhookEndpoint, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []webhookEndpoint
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// webhookDelivery is one event on its way to one endpoint, and the outcome
+// of the latest attempt to send it.
+type webhookDelivery struct {
+	ID             int64      `json:"id"`
+	EndpointID     string     `json:"endpoint_id"`
+	EventID        string     `json:"event_id"`
+	Event          string     `json:"event"`
+	AlbumID        string     `json:"album_id"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event, album_id, payload, status, attempts,
+    next_attempt_at, last_attempt_at, response_status, last_error, created_at, delivered_at`
+
+func scanWebhookDelivery(row scanner) (webhookDelivery, error) {
+	var d webhookDelivery
+	err := row.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.Event, &d.AlbumID, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastAttemptAt, &d.ResponseStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	return d, err
+}
+
+func queryWebhookDeliveries(query string, args ...any) ([]webhookDelivery, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func newWebhookToken(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// webhookPayload is the JSON body of every delivery. ID is the same for
+// each endpoint the event goes to, and across redeliveries, so receivers
+// can drop repeats.
+type webhookPayload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Album     *album    `json:"album"`
+}
+
+// enqueueWebhooks writes an album change to the outbox for every endpoint
+// that wants it, in the transaction making the change, so a change is
+// announced if and only if it commits. deliverWebhooks sends it from
+// there.
+func enqueueWebhooks(tx *sql.Tx, action string, before, after *album) error {
+	event, ok := webhookEventForAction[action]
+	if !ok {
+		return nil
+	}
+	a := after
+	if a == nil {
+		a = before
+	}
+	payload := webhookPayload{ID: newWebhookToken("evt_"), Event: event, CreatedAt: time.Now().UTC(), Album: a}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        INSERT INTO webhook_deliveries (endpoint_id, event_id, event, album_id, payload)
+        SELECT id, $1, $2::text, $3, $4 FROM webhook_endpoints
+        WHERE active AND (cardinality(events) = 0 OR $2::text = ANY(events))`,
+		payload.ID, event, a.ID, string(body))
+	return err
+}
+
+// webhookRetryDelay is how long to wait after a delivery's nth failed
+// attempt.
+func webhookRetryDelay(attempts int) time.Duration {
+	d := webhookBaseDelay
+	for i := 1; i < attempts && d < webhookMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, webhookMaxDelay)
+}
+
+// deliverWebhooks sends the deliveries in the outbox that are due. Each
+// is locked while it is sent, so a redelivery or a run that overlaps a
+// stuck one never sends anything twice. It stops early at shutdown; the
+// rest wait for the next run.
+func deliverWebhooks(ctx context.Context, _ struct{}) error {
+	for ctx.Err() == nil {
+		sent, err := deliverNextWebhook()
+		if err != nil || !sent {
+			return err
+		}
+	}
+	return nil
+}
+
+var deliverWebhooksJob = registerJob("deliver_webhooks", jobOptions{Every: webhookPollInterval}, deliverWebhooks)
+
+// deliverNextWebhook makes one attempt at the oldest due delivery. It
+// reports false when none is due.
+func deliverNextWebhook() (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	d, err := scanWebhookDelivery(tx.QueryRow(`
+        SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+        WHERE status = 'pending' AND next_attempt_at <= now()
+        ORDER BY next_attempt_at, id LIMIT 1
+        FOR UPDATE SKIP LOCKED`))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e, err := scanWebhookEndpoint(tx.QueryRow("SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE id = $1", d.EndpointID))
+	if err != nil {
+		return false, err
+	}
+
+	var status *int
+	var failure string
+	if !e.Active {
+		failure = "endpoint disabled"
+	} else {
+		code, err := sendWebhook(e, d)
+		if code != 0 {
+			status = &code
+		}
+		if err != nil {
+			failure = err.Error()
+		}
+	}
+
+	attempts := d.Attempts + 1
+	switch {
+	case failure == "":
+		_, err = tx.Exec(`
+            UPDATE webhook_deliveries SET status = 'delivered', attempts = $1, last_attempt_at = now(),
+                response_status = $2, last_error = '', delivered_at = now()
+            WHERE id = $3`, attempts, status, d.ID)
+	case attempts >= webhookMaxAttempts || !e.Active:
+		_, err = tx.Exec(`
+            UPDATE webhook_deliveries SET status = 'dead', attempts = $1, last_attempt_at = now(),
+                response_status = $2, last_error = $3
+            WHERE id = $4`, attempts, status, failure, d.ID)
+	default:
+		_, err = tx.Exec(`
+            UPDATE webhook_deliveries SET attempts = $1, last_attempt_at = now(),
+                response_status = $2, last_error = $3, next_attempt_at = now() + make_interval(secs => $4)
+            WHERE id = $5`, attempts, status, failure, webhookRetryDelay(attempts).Seconds(), d.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// sendWebhook posts a delivery's payload, signed with the endpoint's
+// secret the same way payment webhooks are. Any 2xx reply counts as
+// delivered. It returns the reply's status code, or 0 if there was none.
+// The body of the reply is not kept: the endpoint is someone else's, and
+// the log only needs to say that it refused.
+func sendWebhook(e webhookEndpoint, d webhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "web-service-gin-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-ID", d.EventID)
+	req.Header.Set("X-Webhook-Signature", signWebhook(e.Secret, time.Now(), body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, errors.New(resp.Status)
+}
+
+func getWebhooks(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage webhooks"})
+		return
+	}
+	endpoints, err := queryWebhookEndpoints("SELECT " + webhookEndpointColumns + " FROM webhook_endpoints ORDER BY active DESC, id")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch responseVariant(c) {
+	case "fragment":
+		render(c, 200, WebhookList(endpoints))
+	case "json":
+		c.JSON(http.StatusOK, endpoints)
+	default:
+		render(c, 200, WebhooksPage(endpoints))
+	}
+}
+
+// postWebhook registers an endpoint. Its signing secret is generated here
+// and shown to staff with the endpoint.
+func postWebhook(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage webhooks"})
+		return
+	}
+	e := webhookEndpoint{
+		URL:         strings.TrimSpace(c.PostForm("url")),
+		Description: strings.TrimSpace(c.PostForm("description")),
+		Events:      c.PostFormArray("events"),
+		Secret:      newWebhookToken("whsec_"),
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an http or https URL"})
+		return
+	}
+	if err = checkWebhookHost(c.Request.Context(), u.Hostname()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url: " + err.Error()})
+		return
+	}
+	if e.Events == nil {
+		e.Events = []string{}
+	}
+	for _, event := range e.Events {
+		if !slices.Contains(webhookEvents, event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "events must be among " + strings.Join(webhookEvents, ", ")})
+			return
+		}
+	}
+
+	e, err = scanWebhookEndpoint(db.QueryRow(`
+        INSERT INTO webhook_endpoints (url, description, events, secret) VALUES ($1, $2, $3, $4)
+        RETURNING `+webhookEndpointColumns, e.URL, e.Description, pq.Array(e.Events), e.Secret))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		getWebhooks(c)
+		return
+	}
+	c.JSON(http.StatusCreated, e)
+}
+
+// deleteWebhook disables an endpoint. Its delivery log is kept, and what
+// it had pending dies on the next attempt.
+func deleteWebhook(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage webhooks"})
+		return
+	}
+	res, err := db.Exec("UPDATE webhook_endpoints SET active = false WHERE id = $1 AND active", c.Param("webhookID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		getWebhooks(c)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getWebhookDeliveries is an endpoint's delivery log, newest first.
+// ?status= narrows it to pending, delivered or dead deliveries.
+func getWebhookDeliveries(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage webhooks"})
+		return
+	}
+	e, err := scanWebhookEndpoint(db.QueryRow("SELECT "+webhookEndpointColumns+" FROM webhook_endpoints WHERE id = $1", c.Param("webhookID")))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := c.Query("status")
+	deliveries, err := queryWebhookDeliveries(`
+        SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+        WHERE endpoint_id = $1 AND ($2::text = '' OR status = $2::text)
+        ORDER BY id DESC LIMIT $3`, e.ID, status, webhookDeliveryLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch responseVariant(c) {
+	case "json":
+		c.JSON(http.StatusOK, deliveries)
+	default:
+		render(c, 200, WebhookDeliveriesPage(e, deliveries, status))
+	}
+}
+
+// redeliverWebhook sends a delivery's event again as a new delivery, due
+// now, leaving the original in the log as it was. It works for any
+// delivery, not only dead ones, so a receiver that lost an event can have
+// it back.
+func redeliverWebhook(c *gin.Context) {
+	if !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only staff can manage webhooks"})
+		return
+	}
+	d, err := scanWebhookDelivery(db.QueryRow(`
+        INSERT INTO webhook_deliveries (endpoint_id, event_id, event, album_id, payload)
+        SELECT endpoint_id, event_id, event, album_id, payload FROM webhook_deliveries
+        WHERE id = $1 AND endpoint_id = $2
+        RETURNING `+webhookDeliveryColumns, c.Param("deliveryID"), c.Param("webhookID")))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		render(c, 200, webhookDeliveryRow(d))
+		return
+	}
+	c.JSON(http.StatusCreated, d)
+}